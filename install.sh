@@ -1,6 +1,7 @@
 #!/bin/sh
 ver="`llvm-config --version`"
 export CGO_CFLAGS="`llvm-config --cflags` -I ../include"
+export CGO_CXXFLAGS="`llvm-config --cxxflags`"
 export CGO_LDFLAGS="`llvm-config --ldflags` -Wl,-L`llvm-config --libdir` -lLLVM-$ver"
 
 case "$ver" in
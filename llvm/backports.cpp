@@ -0,0 +1,522 @@
+#include "backports.h"
+#include "llvm/ADT/SmallString.h"
+#include "llvm/ADT/StringExtras.h"
+#include "llvm/BasicBlock.h"
+#include "llvm/Bitcode/ReaderWriter.h"
+#include "llvm/ExecutionEngine/ExecutionEngine.h"
+#include "llvm/ExecutionEngine/GenericValue.h"
+#include "llvm/ExecutionEngine/MCJIT.h"
+#include "llvm/DataLayout.h"
+#include "llvm/DerivedTypes.h"
+#include "llvm/Function.h"
+#include "llvm/GlobalValue.h"
+#include "llvm/Instructions.h"
+#include "llvm/LLVMContext.h"
+#include "llvm/Metadata.h"
+#include "llvm/Linker.h"
+#include "llvm/Module.h"
+#include "llvm/PassManager.h"
+#include "llvm/Support/DynamicLibrary.h"
+#include "llvm/Support/ErrorHandling.h"
+#include "llvm/Support/FormattedStream.h"
+#include "llvm/Support/IRReader.h"
+#include "llvm/Support/MemoryBuffer.h"
+#include "llvm/Support/SourceMgr.h"
+#include "llvm/Support/raw_ostream.h"
+#include "llvm/Target/TargetMachine.h"
+#include "llvm/Target/TargetOptions.h"
+#include "llvm/Transforms/IPO.h"
+#include "llvm/Transforms/IPO/PassManagerBuilder.h"
+#include <algorithm>
+#include <cstdlib>
+#include <cstring>
+#include <vector>
+
+using namespace llvm;
+
+LLVMMemoryBufferRef gollvm_create_memory_buffer_with_memory_range_copy(
+    const char *InputData, size_t InputDataLength, const char *BufferName) {
+  return wrap(MemoryBuffer::getMemBufferCopy(
+      StringRef(InputData, InputDataLength), StringRef(BufferName)));
+}
+
+LLVMMemoryBufferRef gollvm_write_bitcode_to_memory_buffer(LLVMModuleRef M) {
+  std::string Data;
+  raw_string_ostream OS(Data);
+  WriteBitcodeToFile(unwrap(M), OS);
+  return wrap(MemoryBuffer::getMemBufferCopy(OS.str()));
+}
+
+const char *gollvm_get_buffer_start(LLVMMemoryBufferRef MemBuf) {
+  return unwrap(MemBuf)->getBufferStart();
+}
+
+size_t gollvm_get_buffer_size(LLVMMemoryBufferRef MemBuf) {
+  return unwrap(MemBuf)->getBufferSize();
+}
+
+LLVMBool gollvm_is_materializable(LLVMValueRef GV) {
+  return unwrap<GlobalValue>(GV)->isMaterializable();
+}
+
+LLVMBool gollvm_materialize(LLVMValueRef GV, char **OutMessage) {
+  std::string Message;
+  if (unwrap<GlobalValue>(GV)->Materialize(&Message)) {
+    *OutMessage = strdup(Message.c_str());
+    return 1;
+  }
+  return 0;
+}
+
+LLVMBool gollvm_materialize_all(LLVMModuleRef M, char **OutMessage) {
+  std::string Message;
+  if (unwrap(M)->MaterializeAll(&Message)) {
+    *OutMessage = strdup(Message.c_str());
+    return 1;
+  }
+  return 0;
+}
+
+char *gollvm_print_module_to_string(LLVMModuleRef M) {
+  std::string Buf;
+  raw_string_ostream OS(Buf);
+  unwrap(M)->print(OS, 0);
+  return strdup(OS.str().c_str());
+}
+
+char *gollvm_print_value_to_string(LLVMValueRef V) {
+  std::string Buf;
+  raw_string_ostream OS(Buf);
+  unwrap(V)->print(OS);
+  return strdup(OS.str().c_str());
+}
+
+char *gollvm_print_type_to_string(LLVMTypeRef T) {
+  std::string Buf;
+  raw_string_ostream OS(Buf);
+  unwrap(T)->print(OS);
+  return strdup(OS.str().c_str());
+}
+
+LLVMModuleRef gollvm_parse_ir(LLVMContextRef C, const char *Data,
+                              size_t DataLength, const char *Name,
+                              char **OutMessage, char **OutLineContents,
+                              int *OutLine, int *OutColumn) {
+  MemoryBuffer *Buf =
+      MemoryBuffer::getMemBufferCopy(StringRef(Data, DataLength), Name);
+  SMDiagnostic Err;
+  // ParseIR takes ownership of the buffer.
+  Module *M = ParseIR(Buf, Err, *unwrap(C));
+  if (!M) {
+    *OutMessage = strdup(Err.getMessage().str().c_str());
+    *OutLineContents = strdup(Err.getLineContents().str().c_str());
+    *OutLine = Err.getLineNo();
+    *OutColumn = Err.getColumnNo();
+  }
+  return wrap(M);
+}
+
+// gollvm_create_execution_engine_for_module is
+// LLVMCreateExecutionEngineForModule, but also reports whether it fell back
+// to creating an interpreter because no JIT could be created.
+LLVMBool gollvm_create_execution_engine_for_module(
+    LLVMExecutionEngineRef *OutEE, LLVMModuleRef M, LLVMBool *OutInterpreter,
+    char **OutError) {
+  std::string Error;
+  EngineBuilder Builder(unwrap(M));
+  Builder.setEngineKind(EngineKind::JIT).setErrorStr(&Error);
+  ExecutionEngine *EE = Builder.create();
+  *OutInterpreter = 0;
+  if (!EE) {
+    Builder.setEngineKind(EngineKind::Interpreter);
+    EE = Builder.create();
+    *OutInterpreter = EE != 0;
+  }
+  if (!EE) {
+    *OutError = strdup(Error.c_str());
+    return 1;
+  }
+  *OutEE = reinterpret_cast<LLVMExecutionEngineRef>(EE);
+  return 0;
+}
+
+void gollvm_link_in_mcjit(void) {
+  LLVMLinkInMCJIT();
+}
+
+static CodeModel::Model unwrapCodeModel(LLVMCodeModel Model) {
+  switch (Model) {
+  case LLVMCodeModelDefault:
+    return CodeModel::Default;
+  case LLVMCodeModelSmall:
+    return CodeModel::Small;
+  case LLVMCodeModelKernel:
+    return CodeModel::Kernel;
+  case LLVMCodeModelMedium:
+    return CodeModel::Medium;
+  case LLVMCodeModelLarge:
+    return CodeModel::Large;
+  default:
+    return CodeModel::JITDefault;
+  }
+}
+
+static LLVMCodeModel wrapCodeModel(CodeModel::Model Model) {
+  switch (Model) {
+  case CodeModel::Default:
+    return LLVMCodeModelDefault;
+  case CodeModel::Small:
+    return LLVMCodeModelSmall;
+  case CodeModel::Kernel:
+    return LLVMCodeModelKernel;
+  case CodeModel::Medium:
+    return LLVMCodeModelMedium;
+  case CodeModel::Large:
+    return LLVMCodeModelLarge;
+  default:
+    return LLVMCodeModelJITDefault;
+  }
+}
+
+LLVMBool gollvm_create_mcjit_compiler_for_module(
+    LLVMExecutionEngineRef *OutJIT, LLVMModuleRef M, unsigned OptLevel,
+    LLVMCodeModel CodeModel, LLVMBool NoFramePointerElim,
+    LLVMBool EnableFastISel, char **OutError) {
+  TargetOptions Options;
+  Options.NoFramePointerElim = NoFramePointerElim;
+
+  std::string Error;
+  EngineBuilder Builder(unwrap(M));
+  Builder.setEngineKind(EngineKind::JIT)
+      .setErrorStr(&Error)
+      .setUseMCJIT(true)
+      .setOptLevel((CodeGenOpt::Level)OptLevel)
+      .setCodeModel(unwrapCodeModel(CodeModel))
+      .setTargetOptions(Options);
+
+  TargetMachine *TM = Builder.selectTarget();
+  if (!TM) {
+    *OutError = strdup(Error.c_str());
+    return 1;
+  }
+  if (EnableFastISel)
+    TM->setFastISel(true);
+  if (ExecutionEngine *JIT = Builder.create(TM)) {
+    *OutJIT = reinterpret_cast<LLVMExecutionEngineRef>(JIT);
+    return 0;
+  }
+  *OutError = strdup(Error.c_str());
+  return 1;
+}
+
+// gollvm_get_mcjit_global_value_address returns the address at which MCJIT
+// loaded the global GV. MCJIT does not implement getPointerToGlobal for
+// variables, so the default implementation emits a separate copy of them.
+// It does look up defined functions by name in the loaded object, however,
+// so it is asked for a throwaway function definition with GV's name.
+void *gollvm_get_mcjit_global_value_address(LLVMExecutionEngineRef EE,
+                                             LLVMValueRef GV) {
+  GlobalValue *G = unwrap<GlobalValue>(GV);
+  LLVMContext &Context = G->getContext();
+  Module Lookup("gollvm.mcjit.lookup", Context);
+  Function *F = Function::Create(
+      FunctionType::get(Type::getVoidTy(Context), false),
+      GlobalValue::ExternalLinkage, G->getName(), &Lookup);
+  ReturnInst::Create(Context, BasicBlock::Create(Context, "entry", F));
+  return reinterpret_cast<ExecutionEngine *>(EE)->getPointerToFunction(F);
+}
+
+void *gollvm_search_for_address_of_symbol(const char *Name) {
+  return sys::DynamicLibrary::SearchForAddressOfSymbol(Name);
+}
+
+LLVMGenericValueRef gollvm_create_generic_value_of_words(LLVMTypeRef Ty,
+                                                         unsigned NumWords,
+                                                         const uint64_t *Words) {
+  GenericValue *GenVal = new GenericValue();
+  GenVal->IntVal = APInt(unwrap<IntegerType>(Ty)->getBitWidth(),
+                         ArrayRef<uint64_t>(Words, NumWords));
+  return reinterpret_cast<LLVMGenericValueRef>(GenVal);
+}
+
+void gollvm_generic_value_to_words(LLVMGenericValueRef GenVal,
+                                   unsigned NumWords, uint64_t *Words) {
+  const APInt &IntVal = reinterpret_cast<GenericValue *>(GenVal)->IntVal;
+  const uint64_t *Raw = IntVal.getRawData();
+  for (unsigned i = 0; i < NumWords; ++i)
+    Words[i] = i < IntVal.getNumWords() ? Raw[i] : 0;
+}
+
+// The interpreter calls an external function F through the function
+// exported as "lle_X_" followed by F's name, if there is one. Functions
+// registered with gollvm_register_external_function are exported as one of
+// a fixed set of trampolines, each of which knows the name it was
+// registered under, and calls the Go implementation registered with the
+// execution engine that is running on the current thread.
+
+extern "C" int gollvmCallExternalFunction(LLVMExecutionEngineRef EE,
+                                          char *Name, unsigned NumArgs,
+                                          LLVMGenericValueRef *Args,
+                                          LLVMGenericValueRef *Result);
+
+typedef GenericValue (*ExternalFn)(FunctionType *,
+                                   const std::vector<GenericValue> &);
+
+static const unsigned NumExternalSlots = 256;
+static std::string ExternalNames[NumExternalSlots];
+static unsigned NumExternals;
+
+static __thread LLVMExecutionEngineRef CurrentEngine;
+
+namespace {
+// CurrentEngineScope sets CurrentEngine for the duration of a call into an
+// execution engine.
+class CurrentEngineScope {
+  LLVMExecutionEngineRef Saved;
+
+public:
+  CurrentEngineScope(LLVMExecutionEngineRef EE) : Saved(CurrentEngine) {
+    CurrentEngine = EE;
+  }
+  ~CurrentEngineScope() { CurrentEngine = Saved; }
+};
+}
+
+static GenericValue callExternal(unsigned Slot,
+                                 const std::vector<GenericValue> &Args) {
+  std::vector<LLVMGenericValueRef> ArgRefs;
+  for (unsigned i = 0; i < Args.size(); ++i)
+    ArgRefs.push_back(
+        reinterpret_cast<LLVMGenericValueRef>(new GenericValue(Args[i])));
+
+  LLVMGenericValueRef ResultRef = 0;
+  const std::string &Name = ExternalNames[Slot];
+  int Found = gollvmCallExternalFunction(
+      CurrentEngine, const_cast<char *>(Name.c_str()), ArgRefs.size(),
+      ArgRefs.empty() ? 0 : &ArgRefs[0], &ResultRef);
+
+  GenericValue Result;
+  if (ResultRef)
+    Result = *reinterpret_cast<GenericValue *>(ResultRef);
+  for (unsigned i = 0; i < ArgRefs.size(); ++i) {
+    if (ArgRefs[i] == ResultRef)
+      ResultRef = 0;
+    delete reinterpret_cast<GenericValue *>(ArgRefs[i]);
+  }
+  delete reinterpret_cast<GenericValue *>(ResultRef);
+
+  if (!Found)
+    report_fatal_error("Tried to execute an unknown external function: " +
+                       Name);
+  return Result;
+}
+
+template <unsigned Slot>
+static GenericValue externalTrampoline(FunctionType *,
+                                       const std::vector<GenericValue> &Args) {
+  return callExternal(Slot, Args);
+}
+
+template <unsigned N> struct ExternalTrampolines {
+  static void fill(ExternalFn *Table) {
+    Table[N - 1] = externalTrampoline<N - 1>;
+    ExternalTrampolines<N - 1>::fill(Table);
+  }
+};
+
+template <> struct ExternalTrampolines<0> {
+  static void fill(ExternalFn *) {}
+};
+
+// gollvm_register_external_function exports a trampoline for the named
+// function, and returns its slot, or -1 if all slots are in use. Callers
+// must serialize calls.
+int gollvm_register_external_function(const char *Name) {
+  static ExternalFn Table[NumExternalSlots];
+  if (!Table[0])
+    ExternalTrampolines<NumExternalSlots>::fill(Table);
+
+  for (unsigned i = 0; i < NumExternals; ++i)
+    if (ExternalNames[i] == Name)
+      return i;
+  if (NumExternals == NumExternalSlots)
+    return -1;
+  unsigned Slot = NumExternals++;
+  ExternalNames[Slot] = Name;
+  sys::DynamicLibrary::AddSymbol(std::string("lle_X_") + Name,
+                                 (void *)(intptr_t)Table[Slot]);
+  return Slot;
+}
+
+LLVMGenericValueRef gollvm_run_function(LLVMExecutionEngineRef EE,
+                                        LLVMValueRef F, unsigned NumArgs,
+                                        LLVMGenericValueRef *Args) {
+  CurrentEngineScope Scope(EE);
+  return LLVMRunFunction(EE, F, NumArgs, Args);
+}
+
+int gollvm_run_function_as_main(LLVMExecutionEngineRef EE, LLVMValueRef F,
+                                unsigned ArgC, const char *const *ArgV,
+                                const char *const *EnvP) {
+  CurrentEngineScope Scope(EE);
+  return LLVMRunFunctionAsMain(EE, F, ArgC, ArgV, EnvP);
+}
+
+void gollvm_run_static_constructors(LLVMExecutionEngineRef EE) {
+  CurrentEngineScope Scope(EE);
+  LLVMRunStaticConstructors(EE);
+}
+
+void gollvm_run_static_destructors(LLVMExecutionEngineRef EE) {
+  CurrentEngineScope Scope(EE);
+  LLVMRunStaticDestructors(EE);
+}
+
+LLVMCodeGenOptLevel gollvm_get_target_machine_opt_level(LLVMTargetMachineRef T) {
+  switch (reinterpret_cast<TargetMachine *>(T)->getOptLevel()) {
+  case CodeGenOpt::None:
+    return LLVMCodeGenLevelNone;
+  case CodeGenOpt::Less:
+    return LLVMCodeGenLevelLess;
+  case CodeGenOpt::Aggressive:
+    return LLVMCodeGenLevelAggressive;
+  default:
+    return LLVMCodeGenLevelDefault;
+  }
+}
+
+LLVMRelocMode gollvm_get_target_machine_reloc_mode(LLVMTargetMachineRef T) {
+  switch (reinterpret_cast<TargetMachine *>(T)->getRelocationModel()) {
+  case Reloc::Static:
+    return LLVMRelocStatic;
+  case Reloc::PIC_:
+    return LLVMRelocPIC;
+  case Reloc::DynamicNoPIC:
+    return LLVMRelocDynamicNoPic;
+  default:
+    return LLVMRelocDefault;
+  }
+}
+
+LLVMCodeModel gollvm_get_target_machine_code_model(LLVMTargetMachineRef T) {
+  return wrapCodeModel(reinterpret_cast<TargetMachine *>(T)->getCodeModel());
+}
+
+// gollvm_pass_manager_builder_use_always_inliner makes the builder's inliner
+// one that only inlines functions marked always_inline, as clang does when
+// not otherwise inlining.
+void gollvm_pass_manager_builder_use_always_inliner(
+    LLVMPassManagerBuilderRef PMB, LLVMBool InsertLifetime) {
+  PassManagerBuilder *Builder = reinterpret_cast<PassManagerBuilder *>(PMB);
+  delete Builder->Inliner;
+  Builder->Inliner = createAlwaysInlinerPass(InsertLifetime);
+}
+
+// gollvm_target_machine_emit_to_memory_buffer is LLVMTargetMachineEmitToFile,
+// but emitting to a memory buffer rather than a named file.
+LLVMBool gollvm_target_machine_emit_to_memory_buffer(
+    LLVMTargetMachineRef T, LLVMModuleRef M, LLVMCodeGenFileType CodeGen,
+    char **ErrorMessage, LLVMMemoryBufferRef *OutMemBuf) {
+  TargetMachine *TM = reinterpret_cast<TargetMachine *>(T);
+  const DataLayout *TD = TM->getDataLayout();
+  if (!TD) {
+    *ErrorMessage = strdup("No DataLayout in TargetMachine");
+    return 1;
+  }
+  PassManager PM;
+  PM.add(new DataLayout(*TD));
+
+  TargetMachine::CodeGenFileType FT = CodeGen == LLVMAssemblyFile
+                                          ? TargetMachine::CGFT_AssemblyFile
+                                          : TargetMachine::CGFT_ObjectFile;
+  SmallString<0> Code;
+  {
+    raw_svector_ostream OS(Code);
+    formatted_raw_ostream FOS(OS);
+    if (TM->addPassesToEmitFile(PM, FOS, FT)) {
+      *ErrorMessage = strdup("TargetMachine can't emit a file of this type");
+      return 1;
+    }
+    PM.run(*unwrap(M));
+  }
+  *OutMemBuf = wrap(MemoryBuffer::getMemBufferCopy(Code.str()));
+  return 0;
+}
+
+// gollvm_md_node_temporary creates a temporary metadata node in the global
+// context, which must be replaced with gollvm_md_node_replace_temporary.
+LLVMValueRef gollvm_md_node_temporary(void) {
+  return wrap(MDNode::getTemporary(getGlobalContext(), ArrayRef<Value *>()));
+}
+
+// gollvm_md_node_replace_temporary replaces all uses of the temporary node
+// Temp with New, and deletes Temp.
+void gollvm_md_node_replace_temporary(LLVMValueRef Temp, LLVMValueRef New) {
+  MDNode *N = unwrap<MDNode>(Temp);
+  N->replaceAllUsesWith(unwrap(New));
+  MDNode::deleteTemporary(N);
+}
+
+// gollvm_replace_function_body links NewBody into the module defining Fn,
+// and moves the body of NewBody's function of the same name into Fn, so
+// that Fn keeps its identity, and therefore its execution engine mappings.
+LLVMBool gollvm_replace_function_body(LLVMValueRef Fn, LLVMModuleRef NewBody,
+                                      char **OutMessage) {
+  Function *F = unwrap<Function>(Fn);
+  Module *Dest = F->getParent();
+  Module *Src = unwrap(NewBody);
+  Function *NewF = Src->getFunction(F->getName());
+
+  // Give the replacement a name that is unique in both modules, so that it
+  // can be found once linked.
+  std::string Name = F->getName().str() + ".replacement";
+  for (unsigned i = 1; Dest->getNamedValue(Name) || Src->getNamedValue(Name);
+       ++i)
+    Name = F->getName().str() + ".replacement" + utostr(i);
+  NewF->setName(Name);
+
+  std::string Message;
+  if (Linker::LinkModules(Dest, Src, Linker::DestroySource, &Message)) {
+    *OutMessage = strdup(Message.c_str());
+    return 1;
+  }
+  NewF = Dest->getFunction(Name);
+
+  GlobalValue::LinkageTypes Linkage = F->getLinkage();
+  F->deleteBody();
+  F->setLinkage(Linkage);
+  F->getBasicBlockList().splice(F->end(), NewF->getBasicBlockList());
+  for (Function::arg_iterator A = F->arg_begin(), NewA = NewF->arg_begin(),
+                              E = NewF->arg_end();
+       NewA != E; ++A, ++NewA) {
+    A->takeName(NewA);
+    NewA->replaceAllUsesWith(A);
+  }
+  NewF->replaceAllUsesWith(F);
+  NewF->eraseFromParent();
+  return 0;
+}
+
+// The LLVM C API's LLVMGetRelocationTypeName and LLVMGetRelocationValueString
+// return strings without a terminating NUL, so are reimplemented here.
+
+static char *copyToCString(const SmallVectorImpl<char> &S) {
+  char *Str = static_cast<char *>(malloc(S.size() + 1));
+  std::copy(S.begin(), S.end(), Str);
+  Str[S.size()] = '\0';
+  return Str;
+}
+
+char *gollvm_get_relocation_type_name(LLVMRelocationIteratorRef RI) {
+  SmallVector<char, 0> Ret;
+  if (error_code EC = (*object::unwrap(RI))->getTypeName(Ret))
+    report_fatal_error(EC.message());
+  return copyToCString(Ret);
+}
+
+char *gollvm_get_relocation_value_string(LLVMRelocationIteratorRef RI) {
+  SmallVector<char, 0> Ret;
+  if (error_code EC = (*object::unwrap(RI))->getValueString(Ret))
+    report_fatal_error(EC.message());
+  return copyToCString(Ret);
+}
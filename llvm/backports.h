@@ -0,0 +1,101 @@
+#ifndef GOLLVM_BACKPORTS_H
+#define GOLLVM_BACKPORTS_H
+
+#include <llvm-c/Core.h>
+#include <llvm-c/ExecutionEngine.h>
+#include <llvm-c/Object.h>
+#include <llvm-c/TargetMachine.h>
+#include <stdbool.h> // Used by PassManagerBuilder.h
+#include <llvm-c/Transforms/PassManagerBuilder.h>
+#include <stdint.h>
+
+// Functions in this file provide functionality that is missing from the
+// LLVM C API, and are implemented in backports.cpp.
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// gollvm_uintptr_to_pointer converts an address held by Go as a uintptr
+// to a pointer, which Go code cannot do without upsetting go vet.
+static inline void *gollvm_uintptr_to_pointer(uintptr_t Addr) {
+  return (void *)Addr;
+}
+
+LLVMMemoryBufferRef gollvm_create_memory_buffer_with_memory_range_copy(
+    const char *InputData, size_t InputDataLength, const char *BufferName);
+
+LLVMMemoryBufferRef gollvm_write_bitcode_to_memory_buffer(LLVMModuleRef M);
+
+const char *gollvm_get_buffer_start(LLVMMemoryBufferRef MemBuf);
+size_t gollvm_get_buffer_size(LLVMMemoryBufferRef MemBuf);
+
+LLVMBool gollvm_is_materializable(LLVMValueRef GV);
+LLVMBool gollvm_materialize(LLVMValueRef GV, char **OutMessage);
+LLVMBool gollvm_materialize_all(LLVMModuleRef M, char **OutMessage);
+
+char *gollvm_print_module_to_string(LLVMModuleRef M);
+char *gollvm_print_value_to_string(LLVMValueRef V);
+char *gollvm_print_type_to_string(LLVMTypeRef T);
+
+LLVMModuleRef gollvm_parse_ir(LLVMContextRef C, const char *Data,
+                              size_t DataLength, const char *Name,
+                              char **OutMessage, char **OutLineContents,
+                              int *OutLine, int *OutColumn);
+
+LLVMBool gollvm_create_execution_engine_for_module(
+    LLVMExecutionEngineRef *OutEE, LLVMModuleRef M, LLVMBool *OutInterpreter,
+    char **OutError);
+
+void gollvm_link_in_mcjit(void);
+LLVMBool gollvm_create_mcjit_compiler_for_module(
+    LLVMExecutionEngineRef *OutJIT, LLVMModuleRef M, unsigned OptLevel,
+    LLVMCodeModel CodeModel, LLVMBool NoFramePointerElim,
+    LLVMBool EnableFastISel, char **OutError);
+
+void *gollvm_get_mcjit_global_value_address(LLVMExecutionEngineRef EE,
+                                             LLVMValueRef GV);
+
+void *gollvm_search_for_address_of_symbol(const char *Name);
+
+LLVMGenericValueRef gollvm_create_generic_value_of_words(LLVMTypeRef Ty,
+                                                         unsigned NumWords,
+                                                         const uint64_t *Words);
+void gollvm_generic_value_to_words(LLVMGenericValueRef GenVal,
+                                   unsigned NumWords, uint64_t *Words);
+
+int gollvm_register_external_function(const char *Name);
+LLVMGenericValueRef gollvm_run_function(LLVMExecutionEngineRef EE,
+                                        LLVMValueRef F, unsigned NumArgs,
+                                        LLVMGenericValueRef *Args);
+int gollvm_run_function_as_main(LLVMExecutionEngineRef EE, LLVMValueRef F,
+                                unsigned ArgC, const char *const *ArgV,
+                                const char *const *EnvP);
+void gollvm_run_static_constructors(LLVMExecutionEngineRef EE);
+void gollvm_run_static_destructors(LLVMExecutionEngineRef EE);
+
+LLVMCodeGenOptLevel gollvm_get_target_machine_opt_level(LLVMTargetMachineRef T);
+LLVMRelocMode gollvm_get_target_machine_reloc_mode(LLVMTargetMachineRef T);
+LLVMCodeModel gollvm_get_target_machine_code_model(LLVMTargetMachineRef T);
+
+char *gollvm_get_relocation_type_name(LLVMRelocationIteratorRef RI);
+char *gollvm_get_relocation_value_string(LLVMRelocationIteratorRef RI);
+
+void gollvm_pass_manager_builder_use_always_inliner(
+    LLVMPassManagerBuilderRef PMB, LLVMBool InsertLifetime);
+
+LLVMBool gollvm_target_machine_emit_to_memory_buffer(
+    LLVMTargetMachineRef T, LLVMModuleRef M, LLVMCodeGenFileType CodeGen,
+    char **ErrorMessage, LLVMMemoryBufferRef *OutMemBuf);
+
+LLVMValueRef gollvm_md_node_temporary(void);
+void gollvm_md_node_replace_temporary(LLVMValueRef Temp, LLVMValueRef New);
+
+LLVMBool gollvm_replace_function_body(LLVMValueRef Fn, LLVMModuleRef NewBody,
+                                      char **OutMessage);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif
@@ -3,35 +3,108 @@ package llvm
 /*
 #include <llvm-c/BitReader.h>
 #include <stdlib.h>
+#include "backports.h"
 */
 import "C"
 
 import (
 	"errors"
-	"unsafe"
+	"io"
+	"io/ioutil"
 )
 
 // ParseBitcodeFile parses the LLVM IR (bitcode) in the file with the
 // specified name, and returns a new LLVM module.
 func ParseBitcodeFile(name string) (Module, error) {
-	var buf C.LLVMMemoryBufferRef
-	var errmsg *C.char
-	var cfilename *C.char = C.CString(name)
-	result := C.LLVMCreateMemoryBufferWithContentsOfFile(cfilename, &buf, &errmsg)
-	C.free(unsafe.Pointer(cfilename))
-	if result != 0 {
-		err := errors.New(C.GoString(errmsg))
-		C.free(unsafe.Pointer(errmsg))
+	buf, err := NewMemoryBufferFromFile(name)
+	if err != nil {
+		return Module{}, err
+	}
+	defer buf.Dispose()
+	return GlobalContext().ParseBitcode(buf)
+}
+
+// ParseBitcode parses the LLVM IR (bitcode) in data, and returns a new
+// LLVM module in the global context.
+func ParseBitcode(data []byte) (Module, error) {
+	buf := NewMemoryBufferFromBytes(data, "")
+	defer buf.Dispose()
+	return GlobalContext().ParseBitcode(buf)
+}
+
+// ParseBitcodeReader parses the LLVM IR (bitcode) read from r until EOF,
+// and returns a new LLVM module in the global context.
+func ParseBitcodeReader(r io.Reader) (Module, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
 		return Module{}, err
 	}
-	defer C.LLVMDisposeMemoryBuffer(buf)
+	return ParseBitcode(data)
+}
+
+// ParseBitcode parses the LLVM IR (bitcode) in the memory buffer, and
+// returns a new LLVM module in the context. The memory buffer is not
+// consumed, and must still be disposed of by the caller.
+func (c Context) ParseBitcode(buf MemoryBuffer) (Module, error) {
+	var m Module
+	var errmsg *C.char
+	if C.LLVMParseBitcodeInContext(c.C, buf.C, &m.C, &errmsg) == 0 {
+		return m, nil
+	}
+
+	err := errors.New(C.GoString(errmsg))
+	C.LLVMDisposeMessage(errmsg)
+	return Module{nil}, err
+}
 
+// GetBitcodeModule reads the module header and symbol table from the
+// bitcode in the memory buffer, deferring the reading of function bodies
+// until they are materialized. On success the module takes ownership of
+// the memory buffer, which must not be disposed of separately; on failure
+// the buffer must still be disposed of by the caller.
+func (c Context) GetBitcodeModule(buf MemoryBuffer) (Module, error) {
 	var m Module
-	if C.LLVMParseBitcode(buf, &m.C, &errmsg) == 0 {
+	var errmsg *C.char
+	if C.LLVMGetBitcodeModuleInContext(c.C, buf.C, &m.C, &errmsg) == 0 {
 		return m, nil
 	}
 
 	err := errors.New(C.GoString(errmsg))
-	C.free(unsafe.Pointer(errmsg))
+	C.LLVMDisposeMessage(errmsg)
 	return Module{nil}, err
 }
+
+// GetBitcodeModule lazily reads a module into the global context; see
+// Context.GetBitcodeModule.
+func GetBitcodeModule(buf MemoryBuffer) (Module, error) {
+	return GlobalContext().GetBitcodeModule(buf)
+}
+
+// IsMaterializable reports whether the global value's body has yet to be
+// read from a lazily loaded module.
+func (v Value) IsMaterializable() bool { return C.gollvm_is_materializable(v.C) != 0 }
+
+// Materialize reads the body of the global value from the lazily loaded
+// module that contains it. It is a no-op if the body has already been read.
+func (v Value) Materialize() error {
+	var errmsg *C.char
+	if C.gollvm_materialize(v.C, &errmsg) != 0 {
+		err := errors.New(C.GoString(errmsg))
+		C.LLVMDisposeMessage(errmsg)
+		return err
+	}
+	return nil
+}
+
+// MaterializeAll reads every remaining function body of a lazily loaded
+// module. It must be called before the module is written out or linked
+// with a destructive linker mode.
+func (m Module) MaterializeAll() error {
+	var errmsg *C.char
+	if C.gollvm_materialize_all(m.C, &errmsg) != 0 {
+		err := errors.New(C.GoString(errmsg))
+		C.LLVMDisposeMessage(errmsg)
+		return err
+	}
+	return nil
+}
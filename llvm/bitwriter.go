@@ -3,8 +3,10 @@ package llvm
 /*
 #include <llvm-c/BitWriter.h>
 #include <stdlib.h>
+#include "backports.h"
 */
 import "C"
+import "io"
 import "os"
 import "errors"
 
@@ -18,4 +20,22 @@ func WriteBitcodeToFile(m Module, file *os.File) error {
 	return nil
 }
 
-// TODO(nsf): Figure out way how to make it work with io.Writer
+// WriteBitcodeToMemoryBuffer returns a memory buffer containing the
+// module's bitcode. The buffer must be disposed of by the caller.
+func WriteBitcodeToMemoryBuffer(m Module) (buf MemoryBuffer) {
+	buf.C = C.gollvm_write_bitcode_to_memory_buffer(m.C)
+	return
+}
+
+// WriteBitcode writes the module's bitcode to w.
+func WriteBitcode(m Module, w io.Writer) error {
+	_, err := w.Write(m.Bitcode())
+	return err
+}
+
+// Bitcode returns the module's bitcode.
+func (m Module) Bitcode() []byte {
+	buf := WriteBitcodeToMemoryBuffer(m)
+	defer buf.Dispose()
+	return buf.Bytes()
+}
@@ -3,6 +3,7 @@ package llvm
 /*
 #include <llvm-c/Core.h>
 #include <stdlib.h>
+#include "backports.h"
 */
 import "C"
 import "unsafe"
@@ -377,6 +378,17 @@ func (m Module) Dump() {
 	C.LLVMDumpModule(m.C)
 }
 
+// String returns the module in textual LLVM IR form, or "<nil>" for a nil
+// module. See Module::print.
+func (m Module) String() string {
+	if m.C == nil {
+		return "<nil>"
+	}
+	cstr := C.gollvm_print_module_to_string(m.C)
+	defer C.LLVMDisposeMessage(cstr)
+	return C.GoString(cstr)
+}
+
 func (m Module) PrintToFile(filename string) (err error) {
 	var cmsg *C.char
 
@@ -406,6 +418,20 @@ func (m Module) AddNamedMetadataOperand(name string, operand Value) {
 	C.free(unsafe.Pointer(cname))
 }
 
+// NamedMetadataOperands returns the operands of the named metadata, or nil
+// if the module has none of that name.
+func (m Module) NamedMetadataOperands(name string) []Value {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	n := int(C.LLVMGetNamedMetadataNumOperands(m.C, cname))
+	if n == 0 {
+		return nil
+	}
+	operands := make([]Value, n)
+	C.LLVMGetNamedMetadataOperands(m.C, cname, llvmValueRefPtr(&operands[0]))
+	return operands
+}
+
 //-------------------------------------------------------------------------
 // llvm.Type
 //-------------------------------------------------------------------------
@@ -433,6 +459,17 @@ func (t Type) Context() (c Context) {
 	return
 }
 
+// IRString returns the type in textual LLVM IR form, e.g. "{ i32, i8* }",
+// or "<nil>" for a nil type. See llvm::Type::print.
+func (t Type) IRString() string {
+	if t.C == nil {
+		return "<nil>"
+	}
+	cstr := C.gollvm_print_type_to_string(t.C)
+	defer C.LLVMDisposeMessage(cstr)
+	return C.GoString(cstr)
+}
+
 // Operations on integer types
 func (c Context) Int1Type() (t Type)  { t.C = C.LLVMInt1TypeInContext(c.C); return }
 func (c Context) Int8Type() (t Type)  { t.C = C.LLVMInt8TypeInContext(c.C); return }
@@ -591,6 +628,18 @@ func (v Value) SetName(name string) {
 	C.LLVMSetValueName(v.C, cname)
 	C.free(unsafe.Pointer(cname))
 }
+
+// String returns the value in textual LLVM IR form, or "<nil>" for a nil
+// value. See llvm::Value::print.
+func (v Value) String() string {
+	if v.C == nil {
+		return "<nil>"
+	}
+	cstr := C.gollvm_print_value_to_string(v.C)
+	defer C.LLVMDisposeMessage(cstr)
+	return C.GoString(cstr)
+}
+
 func (v Value) Dump()                       { C.LLVMDumpValue(v.C) }
 func (v Value) ReplaceAllUsesWith(nv Value) { C.LLVMReplaceAllUsesWith(v.C, nv.C) }
 func (v Value) HasMetadata() bool           { return C.LLVMHasMetadata(v.C) != 0 }
@@ -1761,6 +1810,25 @@ func NewMemoryBufferFromStdin() (b MemoryBuffer, err error) {
 	return
 }
 
+// NewMemoryBufferFromBytes creates a memory buffer holding a copy of data.
+func NewMemoryBufferFromBytes(data []byte, name string) (b MemoryBuffer) {
+	var cdata *C.char
+	if len(data) > 0 {
+		cdata = (*C.char)(unsafe.Pointer(&data[0]))
+	}
+	cname := C.CString(name)
+	b.C = C.gollvm_create_memory_buffer_with_memory_range_copy(cdata, C.size_t(len(data)), cname)
+	C.free(unsafe.Pointer(cname))
+	return
+}
+
+// Bytes returns a copy of the contents of the memory buffer.
+func (b MemoryBuffer) Bytes() []byte {
+	cstart := C.gollvm_get_buffer_start(b.C)
+	csize := C.gollvm_get_buffer_size(b.C)
+	return C.GoBytes(unsafe.Pointer(cstart), C.int(csize))
+}
+
 func (b MemoryBuffer) Dispose() { C.LLVMDisposeMemoryBuffer(b.C) }
 
 //-------------------------------------------------------------------------
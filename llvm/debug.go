@@ -22,6 +22,11 @@ SOFTWARE.
 
 package llvm
 
+/*
+#include "backports.h"
+*/
+import "C"
+
 import (
 	"path"
 	"reflect"
@@ -32,19 +37,38 @@ import (
 
 const (
 	LLVMDebugVersion = (11 << 16)
+
+	// DwarfVersion is the value of the "Dwarf Version" module flag added
+	// by Finalize.
+	DwarfVersion = 2
 )
 
+// debugFlagFwdDecl marks a composite type as a declaration, whose
+// definition is found elsewhere; see llvm::DIDescriptor::FlagFwdDecl.
+const debugFlagFwdDecl = 1 << 2
+
 type DwarfTag uint32
 
 const (
-	DW_TAG_compile_unit    DwarfTag = 0x11
-	DW_TAG_variable        DwarfTag = 0x34
-	DW_TAG_base_type       DwarfTag = 0x24
-	DW_TAG_pointer_type    DwarfTag = 0x0F
-	DW_TAG_structure_type  DwarfTag = 0x13
-	DW_TAG_subroutine_type DwarfTag = 0x15
-	DW_TAG_file_type       DwarfTag = 0x29
-	DW_TAG_subprogram      DwarfTag = 0x2E
+	DW_TAG_compile_unit     DwarfTag = 0x11
+	DW_TAG_variable         DwarfTag = 0x34
+	DW_TAG_base_type        DwarfTag = 0x24
+	DW_TAG_pointer_type     DwarfTag = 0x0F
+	DW_TAG_structure_type   DwarfTag = 0x13
+	DW_TAG_subroutine_type  DwarfTag = 0x15
+	DW_TAG_file_type        DwarfTag = 0x29
+	DW_TAG_subprogram       DwarfTag = 0x2E
+	DW_TAG_lexical_block    DwarfTag = 0x0B
+	DW_TAG_auto_variable    DwarfTag = 0x100
+	DW_TAG_arg_variable     DwarfTag = 0x101
+	DW_TAG_array_type       DwarfTag = 0x01
+	DW_TAG_enumeration_type DwarfTag = 0x04
+	DW_TAG_member           DwarfTag = 0x0D
+	DW_TAG_typedef          DwarfTag = 0x16
+	DW_TAG_subrange_type    DwarfTag = 0x21
+	DW_TAG_const_type       DwarfTag = 0x26
+	DW_TAG_enumerator       DwarfTag = 0x28
+	DW_TAG_volatile_type    DwarfTag = 0x35
 )
 
 type DwarfLang uint32
@@ -78,7 +102,19 @@ const (
 )
 
 type DebugInfo struct {
-	cache map[DebugDescriptor]Value
+	// MetadataVersion, if nonzero, is the value of the "Debug Info
+	// Version" module flag added by Finalize. Newer LLVM releases discard
+	// debug information without the flag, but also discard it if the
+	// version does not match their own metadata layout, which differs from
+	// the LLVMDebugVersion layout created here; set it only for a release
+	// known to accept this metadata.
+	MetadataVersion uint32
+
+	cache        map[DebugDescriptor]Value
+	descriptors  []DebugDescriptor // Cached descriptors, in creation order.
+	retained     []DebugDescriptor // Types passed to RetainType.
+	lexicalBlock uint32            // Number of lexical blocks created.
+	finalized    bool
 }
 
 type DebugDescriptor interface {
@@ -111,8 +147,32 @@ func (info *DebugInfo) MDNode(d DebugDescriptor) Value {
 	}
 	value, exists := info.cache[d]
 	if !exists {
-		value = d.mdNode(info)
-		info.cache[d] = value
+		value = info.createMDNode(d)
+		info.descriptors = append(info.descriptors, d)
+	}
+	return value
+}
+
+// createMDNode creates and caches the metadata node for d.
+func (info *DebugInfo) createMDNode(d DebugDescriptor) Value {
+	// Descriptors may refer to themselves, as does a struct with a field
+	// pointing to the struct, so references made while the node is
+	// created refer to a temporary node that is replaced.
+	temp := Value{C.gollvm_md_node_temporary()}
+	info.cache[d] = temp
+	value := d.mdNode(info)
+	C.gollvm_md_node_replace_temporary(temp.C, value.C)
+	info.cache[d] = value
+	return value
+}
+
+// recreateMDNode creates the metadata node for d again, after d has been
+// modified, and replaces all uses of its previous node with the new one.
+func (info *DebugInfo) recreateMDNode(d DebugDescriptor) Value {
+	old := info.cache[d]
+	value := info.createMDNode(d)
+	if value != old {
+		old.ReplaceAllUsesWith(value)
 	}
 	return value
 }
@@ -128,6 +188,158 @@ func (info *DebugInfo) MDNodes(d []DebugDescriptor) []Value {
 	return nil
 }
 
+// RetainType adds the type described by d to the retained types of the
+// compile units of the module, so that it is emitted even if no variable or
+// subprogram refers to it.
+func (info *DebugInfo) RetainType(d DebugDescriptor) {
+	info.retained = appendDebugDescriptor(info.retained, d)
+}
+
+// Finalize completes the debug information for the module, and must be
+// called once all of it has been created. Calls after the first have no
+// effect.
+//
+// Each compile unit created through info has the subprograms, global
+// variables and types created through info added to its lists, if not
+// already present, and is added to the module's llvm.dbg.cu named
+// metadata, if not already present. Enumeration types are added to
+// EnumTypes; named struct types, other than declarations, typedefs and
+// types passed to RetainType are added to RetainedTypes. If there are
+// several compile units, only descriptors whose Context is a unit are
+// added to it. The metadata of each compile unit is then created again
+// with the complete lists, and replaces the previous metadata wherever it
+// is used. Finally, the module flags recording the DWARF version, and the
+// metadata version if MetadataVersion is set, are added.
+func (info *DebugInfo) Finalize(m Module) {
+	if info.finalized {
+		return
+	}
+	info.finalized = true
+
+	var units []*CompileUnitDescriptor
+	for _, d := range info.descriptors {
+		if cu, ok := d.(*CompileUnitDescriptor); ok {
+			units = append(units, cu)
+		}
+	}
+	for _, cu := range units {
+		belongs := func(context DebugDescriptor) bool {
+			return len(units) == 1 || context == DebugDescriptor(cu)
+		}
+		for _, d := range info.descriptors {
+			switch d := d.(type) {
+			case *SubprogramDescriptor:
+				if belongs(d.Context) {
+					cu.Subprograms = appendDebugDescriptor(cu.Subprograms, d)
+				}
+			case *GlobalVariableDescriptor:
+				if belongs(d.Context) {
+					cu.GlobalVariables = appendDebugDescriptor(cu.GlobalVariables, d)
+				}
+			case *CompositeTypeDescriptor:
+				if !belongs(d.Context) {
+					continue
+				}
+				switch {
+				case d.Tag() == DW_TAG_enumeration_type:
+					cu.EnumTypes = appendDebugDescriptor(cu.EnumTypes, d)
+				case d.Tag() == DW_TAG_structure_type && d.Name != "" && d.Flags&debugFlagFwdDecl == 0:
+					cu.RetainedTypes = appendDebugDescriptor(cu.RetainedTypes, d)
+				}
+			case *DerivedTypeDescriptor:
+				if d.Tag() == DW_TAG_typedef && belongs(d.Context) {
+					cu.RetainedTypes = appendDebugDescriptor(cu.RetainedTypes, d)
+				}
+			}
+		}
+		for _, d := range info.retained {
+			if belongs(debugContext(d)) {
+				cu.RetainedTypes = appendDebugDescriptor(cu.RetainedTypes, d)
+			}
+		}
+	}
+	// Create the compile units again once their lists are complete.
+	// Doing so may create more descriptors, which are not added to the
+	// lists.
+	nodes := make([]Value, len(units))
+	for i, cu := range units {
+		nodes[i] = info.recreateMDNode(cu)
+	}
+	// Compile units added to llvm.dbg.cu before Finalize was called now
+	// refer to the new metadata.
+	registered := m.NamedMetadataOperands("llvm.dbg.cu")
+	for _, node := range nodes {
+		if !containsValue(registered, node) {
+			m.AddNamedMetadataOperand("llvm.dbg.cu", node)
+		}
+	}
+
+	const warning = 2 // llvm::Module::Warning
+	m.AddNamedMetadataOperand("llvm.module.flags", MDNode([]Value{
+		ConstInt(Int32Type(), warning, false),
+		MDString("Dwarf Version"),
+		ConstInt(Int32Type(), DwarfVersion, false)}))
+	if info.MetadataVersion != 0 {
+		m.AddNamedMetadataOperand("llvm.module.flags", MDNode([]Value{
+			ConstInt(Int32Type(), warning, false),
+			MDString("Debug Info Version"),
+			ConstInt(Int32Type(), uint64(info.MetadataVersion), false)}))
+	}
+}
+
+// containsValue reports whether values contains v.
+func containsValue(values []Value, v Value) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// debugContext returns the Context of the type described by d.
+func debugContext(d DebugDescriptor) DebugDescriptor {
+	switch d := d.(type) {
+	case *BasicTypeDescriptor:
+		return d.Context
+	case *CompositeTypeDescriptor:
+		return d.Context
+	case *DerivedTypeDescriptor:
+		return d.Context
+	}
+	return nil
+}
+
+// appendDebugDescriptor appends d to list, unless it is already present.
+func appendDebugDescriptor(list []DebugDescriptor, d DebugDescriptor) []DebugDescriptor {
+	for _, existing := range list {
+		if existing == d {
+			return list
+		}
+	}
+	return append(list, d)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Locations.
+
+// Location returns the debug location metadata for the specified line and
+// column within scope, which should be a subprogram or lexical block.
+// inlinedAt is the location at which scope was inlined, or a nil Value.
+func (info *DebugInfo) Location(line, col uint32, scope DebugDescriptor, inlinedAt Value) Value {
+	return MDNode([]Value{
+		ConstInt(Int32Type(), uint64(line), false),
+		ConstInt(Int32Type(), uint64(col), false),
+		info.MDNode(scope),
+		inlinedAt})
+}
+
+// SetDebugLocation sets the debug location attached to subsequently
+// created instructions to the specified line and column within scope.
+func (b Builder) SetDebugLocation(info *DebugInfo, line, col uint32, scope DebugDescriptor) {
+	b.SetCurrentDebugLocation(info.Location(line, col, scope, Value{nil}))
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // Basic Types
 
@@ -174,6 +386,7 @@ type CompositeTypeDescriptor struct {
 	Alignment uint64 // Alignment in bits.
 	Offset    uint64 // Offset in bits
 	Flags     uint32
+	Base      DebugDescriptor // Element type of arrays.
 	Members   []DebugDescriptor
 }
 
@@ -182,6 +395,10 @@ func (d *CompositeTypeDescriptor) Tag() DwarfTag {
 }
 
 func (d *CompositeTypeDescriptor) mdNode(info *DebugInfo) Value {
+	base := MDNode(nil)
+	if d.Base != nil {
+		base = info.MDNode(d.Base)
+	}
 	return MDNode([]Value{
 		ConstInt(Int32Type(), LLVMDebugVersion+uint64(d.Tag()), false),
 		info.MDNode(d.Context),
@@ -192,7 +409,7 @@ func (d *CompositeTypeDescriptor) mdNode(info *DebugInfo) Value {
 		ConstInt(Int32Type(), d.Alignment, false),
 		ConstInt(Int32Type(), d.Offset, false),
 		ConstInt(Int32Type(), uint64(d.Flags), false),
-		MDNode(nil),
+		base,
 		MDNode(info.MDNodes(d.Members)),
 		ConstInt(Int32Type(), uint64(0), false)})
 }
@@ -205,6 +422,28 @@ func NewStructCompositeType(
 	return d
 }
 
+// NewArrayCompositeType returns a descriptor for an array of Base, with a
+// SubrangeDescriptor for each dimension.
+func NewArrayCompositeType(
+	Base DebugDescriptor,
+	Subranges []DebugDescriptor) *CompositeTypeDescriptor {
+	d := new(CompositeTypeDescriptor)
+	d.tag = DW_TAG_array_type
+	d.Base = Base
+	d.Members = Subranges
+	return d
+}
+
+// NewEnumerationCompositeType returns a descriptor for an enumeration
+// type with the specified EnumeratorDescriptors.
+func NewEnumerationCompositeType(
+	Enumerators []DebugDescriptor) *CompositeTypeDescriptor {
+	d := new(CompositeTypeDescriptor)
+	d.tag = DW_TAG_enumeration_type
+	d.Members = Enumerators
+	return d
+}
+
 func NewSubroutineCompositeType(
 	Result DebugDescriptor,
 	Params []DebugDescriptor) *CompositeTypeDescriptor {
@@ -216,6 +455,46 @@ func NewSubroutineCompositeType(
 	return d
 }
 
+///////////////////////////////////////////////////////////////////////////////
+// Subranges
+
+type SubrangeDescriptor struct {
+	Lo    int64 // Lower bound.
+	Count int64 // Number of elements.
+}
+
+func (d *SubrangeDescriptor) Tag() DwarfTag {
+	return DW_TAG_subrange_type
+}
+
+func (d *SubrangeDescriptor) mdNode(info *DebugInfo) Value {
+	// This version of the metadata records the upper bound, not the count.
+	hi := d.Lo + d.Count - 1
+	return MDNode([]Value{
+		ConstInt(Int32Type(), LLVMDebugVersion+uint64(d.Tag()), false),
+		ConstInt(Int64Type(), uint64(d.Lo), true),
+		ConstInt(Int64Type(), uint64(hi), true)})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Enumerators
+
+type EnumeratorDescriptor struct {
+	Name  string
+	Value int64
+}
+
+func (d *EnumeratorDescriptor) Tag() DwarfTag {
+	return DW_TAG_enumerator
+}
+
+func (d *EnumeratorDescriptor) mdNode(info *DebugInfo) Value {
+	return MDNode([]Value{
+		ConstInt(Int32Type(), LLVMDebugVersion+uint64(d.Tag()), false),
+		MDString(d.Name),
+		ConstInt(Int64Type(), uint64(d.Value), true)})
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // Compilation Unit
 
@@ -297,6 +576,38 @@ func NewPointerDerivedType(Base DebugDescriptor) *DerivedTypeDescriptor {
 	return d
 }
 
+// NewMemberDerivedType returns a descriptor for a struct field of type
+// Base. The field's Size, Alignment and Offset must also be set.
+func NewMemberDerivedType(Name string, Base DebugDescriptor) *DerivedTypeDescriptor {
+	d := new(DerivedTypeDescriptor)
+	d.tag = DW_TAG_member
+	d.Name = Name
+	d.Base = Base
+	return d
+}
+
+func NewTypedefDerivedType(Name string, Base DebugDescriptor) *DerivedTypeDescriptor {
+	d := new(DerivedTypeDescriptor)
+	d.tag = DW_TAG_typedef
+	d.Name = Name
+	d.Base = Base
+	return d
+}
+
+func NewConstDerivedType(Base DebugDescriptor) *DerivedTypeDescriptor {
+	d := new(DerivedTypeDescriptor)
+	d.tag = DW_TAG_const_type
+	d.Base = Base
+	return d
+}
+
+func NewVolatileDerivedType(Base DebugDescriptor) *DerivedTypeDescriptor {
+	d := new(DerivedTypeDescriptor)
+	d.tag = DW_TAG_volatile_type
+	d.Base = Base
+	return d
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // Subprograms.
 
@@ -340,6 +651,85 @@ func (d *SubprogramDescriptor) mdNode(info *DebugInfo) Value {
 		MDNode(nil)}) // function variables
 }
 
+///////////////////////////////////////////////////////////////////////////////
+// Lexical Blocks.
+
+type LexicalBlockDescriptor struct {
+	Context DebugDescriptor
+	File    *FileDescriptor
+	Line    uint32
+	Column  uint32
+}
+
+func (d *LexicalBlockDescriptor) Tag() DwarfTag {
+	return DW_TAG_lexical_block
+}
+
+func (d *LexicalBlockDescriptor) mdNode(info *DebugInfo) Value {
+	// Each block carries a unique ID, so that distinct blocks starting at
+	// the same position are not merged.
+	info.lexicalBlock++
+	return MDNode([]Value{
+		ConstInt(Int32Type(), LLVMDebugVersion+uint64(d.Tag()), false),
+		info.MDNode(d.Context),
+		ConstInt(Int32Type(), uint64(d.Line), false),
+		ConstInt(Int32Type(), uint64(d.Column), false),
+		info.MDNode(d.File),
+		ConstInt(Int32Type(), uint64(info.lexicalBlock), false)})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Local Variables.
+
+type LocalVariableDescriptor struct {
+	Context  DebugDescriptor // Subprogram or lexical block.
+	Name     string
+	File     *FileDescriptor
+	Line     uint32
+	Argument uint32 // 1-based parameter number, or 0 for non-parameters.
+	Type     DebugDescriptor
+	Flags    uint32
+}
+
+// Tag returns DW_TAG_arg_variable for parameters, and DW_TAG_auto_variable
+// otherwise.
+func (d *LocalVariableDescriptor) Tag() DwarfTag {
+	if d.Argument != 0 {
+		return DW_TAG_arg_variable
+	}
+	return DW_TAG_auto_variable
+}
+
+func (d *LocalVariableDescriptor) mdNode(info *DebugInfo) Value {
+	return MDNode([]Value{
+		ConstInt(Int32Type(), LLVMDebugVersion+uint64(d.Tag()), false),
+		info.MDNode(d.Context),
+		MDString(d.Name),
+		info.MDNode(d.File),
+		ConstInt(Int32Type(), uint64(d.Line)|uint64(d.Argument)<<24, false),
+		info.MDNode(d.Type),
+		ConstInt(Int32Type(), uint64(d.Flags), false),
+		ConstNull(Int32Type())})
+}
+
+// InsertDeclare emits a call to llvm.dbg.declare at the builder's insertion
+// point, describing the variable whose storage is allocated by alloca. loc
+// is the debug location attached to the call, as returned by Location.
+func (info *DebugInfo) InsertDeclare(b Builder, alloca Value, v *LocalVariableDescriptor, loc Value) Value {
+	m := alloca.InstructionParent().Parent().GlobalParent()
+	declare := m.NamedFunction("llvm.dbg.declare")
+	if declare.IsNil() {
+		metadataType := MDNode(nil).Type()
+		declareType := FunctionType(VoidType(), []Type{metadataType, metadataType}, false)
+		declare = AddFunction(m, "llvm.dbg.declare", declareType)
+	}
+	call := b.CreateCall(declare, []Value{MDNode([]Value{alloca}), info.MDNode(v)}, "")
+	if !loc.IsNil() {
+		call.SetMetadata(MDKindID("dbg"), loc)
+	}
+	return call
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // Global Variables.
 
@@ -0,0 +1,310 @@
+package llvm
+
+///////////////////////////////////////////////////////////////////////////////
+// Go types.
+
+// GoDebugTypes creates descriptors for Go's built-in string, slice,
+// interface, map and channel types, laid out as by the gc runtime and
+// named as gdb's Go support (runtime-gdb.py) expects, so that gdb displays
+// their values rather than their raw representation. Sizes and offsets
+// are computed from TargetData, and from the Size and Alignment of the
+// descriptors of element types.
+type GoDebugTypes struct {
+	TargetData TargetData
+
+	basics  map[string]*BasicTypeDescriptor
+	structs map[string]*CompositeTypeDescriptor
+	pointer *DerivedTypeDescriptor
+	eface   *CompositeTypeDescriptor
+	iface   *CompositeTypeDescriptor
+}
+
+// Map entries larger than this many bits are stored indirectly in map
+// buckets; see the runtime's maxKeySize and maxElemSize.
+const goMaxMapEntrySize = 128 * 8
+
+// goMapBucketCount is the number of entries in each map bucket.
+const goMapBucketCount = 8
+
+func NewGoDebugTypes(td TargetData) *GoDebugTypes {
+	return &GoDebugTypes{TargetData: td}
+}
+
+// wordSize returns the size of a pointer, and of int, in bits.
+func (g *GoDebugTypes) wordSize() uint64 {
+	return uint64(g.TargetData.PointerSize()) * 8
+}
+
+// basic returns the descriptor for the named basic type.
+func (g *GoDebugTypes) basic(name string, size uint64, encoding DwarfTypeEncoding) *BasicTypeDescriptor {
+	if d := g.basics[name]; d != nil {
+		return d
+	}
+	if g.basics == nil {
+		g.basics = make(map[string]*BasicTypeDescriptor)
+	}
+	d := &BasicTypeDescriptor{
+		Name:         name,
+		Size:         size,
+		Alignment:    size,
+		TypeEncoding: encoding,
+	}
+	g.basics[name] = d
+	return d
+}
+
+// Uint8 returns the descriptor for uint8, the element type of strings.
+func (g *GoDebugTypes) Uint8() *BasicTypeDescriptor {
+	return g.basic("uint8", 8, DW_ATE_unsigned)
+}
+
+// Int returns the descriptor for int, the type of lengths and capacities.
+func (g *GoDebugTypes) Int() *BasicTypeDescriptor {
+	return g.basic("int", g.wordSize(), DW_ATE_signed)
+}
+
+func (g *GoDebugTypes) uint() *BasicTypeDescriptor {
+	return g.basic("uint", g.wordSize(), DW_ATE_unsigned)
+}
+
+func (g *GoDebugTypes) uintptr() *BasicTypeDescriptor {
+	return g.basic("uintptr", g.wordSize(), DW_ATE_unsigned)
+}
+
+// UnsafePointer returns the descriptor for unsafe.Pointer.
+func (g *GoDebugTypes) UnsafePointer() *DerivedTypeDescriptor {
+	if g.pointer == nil {
+		g.pointer = g.Pointer(nil)
+		g.pointer.Name = "unsafe.Pointer"
+	}
+	return g.pointer
+}
+
+// Pointer returns a descriptor for a pointer to elem. A nil elem results
+// in an untyped pointer, which debuggers show as void *.
+func (g *GoDebugTypes) Pointer(elem DebugDescriptor) *DerivedTypeDescriptor {
+	d := NewPointerDerivedType(elem)
+	d.Size = g.wordSize()
+	d.Alignment = g.wordSize()
+	return d
+}
+
+// runtimeStruct returns a declaration of the named runtime structure,
+// whose definition the debugger finds in the runtime's own debug
+// information.
+func (g *GoDebugTypes) runtimeStruct(name string) *CompositeTypeDescriptor {
+	if d := g.structs[name]; d != nil {
+		return d
+	}
+	if g.structs == nil {
+		g.structs = make(map[string]*CompositeTypeDescriptor)
+	}
+	d := NewStructCompositeType(nil)
+	d.Name = name
+	d.Flags = debugFlagFwdDecl
+	g.structs[name] = d
+	return d
+}
+
+// StringType returns a descriptor for string.
+func (g *GoDebugTypes) StringType() *CompositeTypeDescriptor {
+	return g.structType("string", []goDebugField{
+		{"str", g.Pointer(g.Uint8())},
+		{"len", g.Int()},
+	})
+}
+
+// SliceType returns a descriptor for []elem.
+func (g *GoDebugTypes) SliceType(elem DebugDescriptor) *CompositeTypeDescriptor {
+	return g.structType("[]"+debugTypeName(elem), []goDebugField{
+		{"array", g.Pointer(elem)},
+		{"len", g.Int()},
+		{"cap", g.Int()},
+	})
+}
+
+// EmptyInterfaceType returns the descriptor for interface{}, which is
+// represented by the runtime's eface structure.
+func (g *GoDebugTypes) EmptyInterfaceType() *CompositeTypeDescriptor {
+	if g.eface == nil {
+		g.eface = g.structType("runtime.eface", []goDebugField{
+			{"_type", g.Pointer(g.runtimeStruct("runtime._type"))},
+			{"data", g.Pointer(nil)},
+		})
+	}
+	return g.eface
+}
+
+// InterfaceType returns the descriptor for non-empty interface types,
+// which are represented by the runtime's iface structure.
+func (g *GoDebugTypes) InterfaceType() *CompositeTypeDescriptor {
+	if g.iface == nil {
+		g.iface = g.structType("runtime.iface", []goDebugField{
+			{"tab", g.Pointer(g.runtimeStruct("runtime.itab"))},
+			{"data", g.Pointer(nil)},
+		})
+	}
+	return g.iface
+}
+
+// MapType returns a descriptor for map[key]elem, which is a typedef of a
+// pointer to the runtime's hmap structure, named hash<key,elem>, whose
+// buckets are described as bucket<key,elem> structures. As in the gc
+// linker's output, the type is a typedef so that its name is retained.
+func (g *GoDebugTypes) MapType(key, elem DebugDescriptor) *DerivedTypeDescriptor {
+	keyName, elemName := debugTypeName(key), debugTypeName(elem)
+	bucketPointer := g.Pointer(nil)
+	bucket := g.structType("bucket<"+keyName+","+elemName+">", []goDebugField{
+		{"tophash", g.arrayType(g.Uint8(), goMapBucketCount)},
+		{"keys", g.arrayType(g.mapEntryType(key), goMapBucketCount)},
+		{"values", g.arrayType(g.mapEntryType(elem), goMapBucketCount)},
+		{"overflow", bucketPointer},
+	})
+	bucketPointer.Base = bucket
+	hash := g.structType("hash<"+keyName+","+elemName+">", []goDebugField{
+		{"count", g.Int()},
+		{"flags", g.Uint8()},
+		{"B", g.Uint8()},
+		{"noverflow", g.basic("uint16", 16, DW_ATE_unsigned)},
+		{"hash0", g.basic("uint32", 32, DW_ATE_unsigned)},
+		{"buckets", bucketPointer},
+		{"oldbuckets", bucketPointer},
+		{"nevacuate", g.uintptr()},
+		{"extra", g.Pointer(nil)},
+	})
+	return NewTypedefDerivedType("map["+keyName+"]"+elemName, g.Pointer(hash))
+}
+
+// mapEntryType returns the type of the keys or values of type t stored in
+// map buckets, which hold large ones indirectly.
+func (g *GoDebugTypes) mapEntryType(t DebugDescriptor) DebugDescriptor {
+	if size, _ := debugTypeLayout(t); size > goMaxMapEntrySize {
+		return g.Pointer(t)
+	}
+	return t
+}
+
+// ChanType returns a descriptor for chan elem, which is a typedef of a
+// pointer to the runtime's hchan structure, named hchan<elem>, as for
+// MapType. The element type is recorded in the elem field of the
+// sudog<elem> structures of its wait queues, which is where gdb looks for
+// it.
+func (g *GoDebugTypes) ChanType(elem DebugDescriptor) *DerivedTypeDescriptor {
+	elemName := debugTypeName(elem)
+	sudogPointer := g.Pointer(nil)
+	sudogPointer.Base = g.structType("sudog<"+elemName+">", []goDebugField{
+		{"g", g.Pointer(g.runtimeStruct("runtime.g"))},
+		{"next", sudogPointer},
+		{"prev", sudogPointer},
+		{"elem", g.Pointer(elem)},
+	})
+	waitq := g.structType("waitq<"+elemName+">", []goDebugField{
+		{"first", sudogPointer},
+		{"last", sudogPointer},
+	})
+	hchan := g.structType("hchan<"+elemName+">", []goDebugField{
+		{"qcount", g.uint()},
+		{"dataqsiz", g.uint()},
+		{"buf", g.Pointer(nil)},
+		{"elemsize", g.basic("uint16", 16, DW_ATE_unsigned)},
+		{"closed", g.basic("uint32", 32, DW_ATE_unsigned)},
+		{"elemtype", g.Pointer(g.runtimeStruct("runtime._type"))},
+		{"sendx", g.uint()},
+		{"recvx", g.uint()},
+		{"recvq", waitq},
+		{"sendq", waitq},
+		{"lock", g.structType("runtime.mutex", []goDebugField{
+			{"key", g.uintptr()},
+		})},
+	})
+	return NewTypedefDerivedType("chan "+elemName, g.Pointer(hchan))
+}
+
+// goDebugField is a field of a structure created by structType.
+type goDebugField struct {
+	name string
+	typ  DebugDescriptor
+}
+
+// structType returns a descriptor for a struct with the specified name and
+// fields, laid out with each field aligned as its type requires.
+func (g *GoDebugTypes) structType(name string, fields []goDebugField) *CompositeTypeDescriptor {
+	var offset, align uint64 = 0, 8
+	members := make([]DebugDescriptor, len(fields))
+	for i, f := range fields {
+		size, falign := debugTypeLayout(f.typ)
+		offset = alignTo(offset, falign)
+		m := NewMemberDerivedType(f.name, f.typ)
+		m.Size = size
+		m.Alignment = falign
+		m.Offset = offset
+		members[i] = m
+		offset += size
+		if falign > align {
+			align = falign
+		}
+	}
+	d := NewStructCompositeType(members)
+	d.Name = name
+	d.Size = alignTo(offset, align)
+	d.Alignment = align
+	return d
+}
+
+// arrayType returns a descriptor for [n]elem.
+func (g *GoDebugTypes) arrayType(elem DebugDescriptor, n int64) *CompositeTypeDescriptor {
+	size, align := debugTypeLayout(elem)
+	d := NewArrayCompositeType(elem, []DebugDescriptor{&SubrangeDescriptor{Count: n}})
+	d.Size = size * uint64(n)
+	d.Alignment = align
+	return d
+}
+
+func alignTo(offset, align uint64) uint64 {
+	if align == 0 {
+		return offset
+	}
+	return (offset + align - 1) / align * align
+}
+
+// debugTypeLayout returns the size and alignment in bits of the type
+// described by d. Types without an alignment are taken to be aligned as
+// their size, up to 64 bits.
+func debugTypeLayout(d DebugDescriptor) (size, align uint64) {
+	switch d := d.(type) {
+	case *BasicTypeDescriptor:
+		size, align = d.Size, d.Alignment
+	case *CompositeTypeDescriptor:
+		size, align = d.Size, d.Alignment
+	case *DerivedTypeDescriptor:
+		size, align = d.Size, d.Alignment
+		if size == 0 && d.Tag() != DW_TAG_pointer_type {
+			return debugTypeLayout(d.Base)
+		}
+	}
+	if align == 0 {
+		align = 8
+		for align < size && align < 64 {
+			align *= 2
+		}
+	}
+	return size, align
+}
+
+// debugTypeName returns the name of the type described by d.
+func debugTypeName(d DebugDescriptor) string {
+	switch d := d.(type) {
+	case *BasicTypeDescriptor:
+		return d.Name
+	case *CompositeTypeDescriptor:
+		return d.Name
+	case *DerivedTypeDescriptor:
+		if d.Name == "" && d.Tag() == DW_TAG_pointer_type {
+			return "*" + debugTypeName(d.Base)
+		}
+		return d.Name
+	}
+	return ""
+}
+
+// vim: set ft=go :
@@ -0,0 +1,15 @@
+#include "_cgo_export.h"
+#include "disassembler.h"
+
+static const char *gollvm_disasm_symbol_lookup(void *info, uint64_t value,
+                                               uint64_t *refType,
+                                               uint64_t pc,
+                                               const char **refName) {
+	return gollvmDisasmSymbolLookup((uintptr_t)info, value, refType, pc,
+	                                (char **)refName);
+}
+
+LLVMDisasmContextRef gollvm_create_disasm(const char *triple, uintptr_t id) {
+	return LLVMCreateDisasm(triple, (void *)id, 0, NULL,
+	                        gollvm_disasm_symbol_lookup);
+}
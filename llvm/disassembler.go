@@ -0,0 +1,165 @@
+package llvm
+
+/*
+#include "disassembler.h"
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+import "errors"
+import "fmt"
+import "strings"
+import "sync"
+
+type (
+	Disassembler struct {
+		C  C.LLVMDisasmContextRef
+		id uintptr
+	}
+
+	// SymbolLookupFunc is called by a Disassembler for each address
+	// referenced by a decoded instruction. pc is the address of the
+	// instruction making the reference. If ok is true, name is printed in
+	// place of the address.
+	SymbolLookupFunc func(addr, pc uint64) (name string, ok bool)
+
+	// Instruction is a single decoded machine instruction.
+	Instruction struct {
+		// Offset is the offset of the instruction from the start of the
+		// disassembled bytes.
+		Offset uint64
+		// Length is the size of the instruction in bytes.
+		Length int
+		// Text is the instruction in the target's assembly syntax.
+		Text string
+	}
+)
+
+func (c Disassembler) IsNil() bool { return c.C == nil }
+
+// disasmState holds the Go side of a Disassembler. The C side refers to it
+// by id, as Go pointers may not be retained by C code.
+type disasmState struct {
+	lookup SymbolLookupFunc
+	names  []*C.char
+}
+
+var (
+	disasmMutex  sync.Mutex
+	disasmStates = make(map[uintptr]*disasmState)
+	disasmNextID uintptr
+)
+
+var createDisasmError = errors.New("Failed to create disassembler")
+
+//-------------------------------------------------------------------------
+// llvm.Disassembler
+//-------------------------------------------------------------------------
+
+// NewDisassembler creates a disassembler for the specified target triple.
+// The target's info, MC and disassembler components must have been
+// initialized; see InitializeAllDisassemblers.
+func NewDisassembler(triple string) (d Disassembler, err error) {
+	disasmMutex.Lock()
+	disasmNextID++
+	d.id = disasmNextID
+	disasmStates[d.id] = &disasmState{}
+	disasmMutex.Unlock()
+
+	ctriple := C.CString(triple)
+	d.C = C.gollvm_create_disasm(ctriple, C.uintptr_t(d.id))
+	C.free(unsafe.Pointer(ctriple))
+	if d.C == nil {
+		disasmMutex.Lock()
+		delete(disasmStates, d.id)
+		disasmMutex.Unlock()
+		d.id = 0
+		err = createDisasmError
+	}
+	return
+}
+
+// SetSymbolLookup sets the function used to symbolize addresses referenced
+// by disassembled instructions. A nil function disables symbolization.
+func (d Disassembler) SetSymbolLookup(f SymbolLookupFunc) {
+	disasmMutex.Lock()
+	if state := disasmStates[d.id]; state != nil {
+		state.lookup = f
+	}
+	disasmMutex.Unlock()
+}
+
+// Disassemble decodes the instructions in code, which is taken to be
+// located at address pc. Decoding stops at the first invalid instruction,
+// in which case the instructions decoded so far are returned along with
+// an error.
+func (d Disassembler) Disassemble(code []byte, pc uint64) ([]Instruction, error) {
+	var insts []Instruction
+	var buf [256]C.char
+	defer d.freeNames()
+	for offset := 0; offset < len(code); {
+		n := C.LLVMDisasmInstruction(d.C,
+			(*C.uint8_t)(unsafe.Pointer(&code[offset])),
+			C.uint64_t(len(code)-offset),
+			C.uint64_t(pc+uint64(offset)),
+			&buf[0], C.size_t(len(buf)))
+		if n == 0 {
+			return insts, fmt.Errorf("invalid instruction at offset %d", offset)
+		}
+		insts = append(insts, Instruction{
+			Offset: uint64(offset),
+			Length: int(n),
+			Text:   strings.TrimSpace(C.GoString(&buf[0])),
+		})
+		offset += int(n)
+	}
+	return insts, nil
+}
+
+// freeNames releases the symbol names handed to LLVM by the lookup
+// callback during the last call to Disassemble.
+func (d Disassembler) freeNames() {
+	disasmMutex.Lock()
+	if state := disasmStates[d.id]; state != nil {
+		for _, cname := range state.names {
+			C.free(unsafe.Pointer(cname))
+		}
+		state.names = nil
+	}
+	disasmMutex.Unlock()
+}
+
+func (d Disassembler) Dispose() {
+	C.LLVMDisasmDispose(d.C)
+	d.freeNames()
+	disasmMutex.Lock()
+	delete(disasmStates, d.id)
+	disasmMutex.Unlock()
+}
+
+//export gollvmDisasmSymbolLookup
+func gollvmDisasmSymbolLookup(id C.uintptr_t, value C.uint64_t, refType *C.uint64_t, pc C.uint64_t, refName **C.char) *C.char {
+	*refType = C.LLVMDisassembler_ReferenceType_InOut_None
+	*refName = nil
+
+	disasmMutex.Lock()
+	state := disasmStates[uintptr(id)]
+	disasmMutex.Unlock()
+	if state == nil || state.lookup == nil {
+		return nil
+	}
+	name, ok := state.lookup(uint64(value), uint64(pc))
+	if !ok {
+		return nil
+	}
+
+	// LLVM only uses the name while printing the current instruction, so
+	// it is kept until Disassemble returns.
+	cname := C.CString(name)
+	disasmMutex.Lock()
+	state.names = append(state.names, cname)
+	disasmMutex.Unlock()
+	return cname
+}
+
+// vim: set ft=go:
@@ -0,0 +1,11 @@
+#ifndef GOLLVM_DISASSEMBLER_H
+#define GOLLVM_DISASSEMBLER_H
+
+#include <llvm-c/Disassembler.h>
+#include <stdint.h>
+
+// gollvm_create_disasm creates a disassembler whose symbol lookup callback
+// is bridged to the Go function registered under id.
+LLVMDisasmContextRef gollvm_create_disasm(const char *triple, uintptr_t id);
+
+#endif
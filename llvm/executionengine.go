@@ -3,12 +3,16 @@ package llvm
 /*
 #include <llvm-c/ExecutionEngine.h>
 #include <stdlib.h>
+#include "backports.h"
 */
 import "C"
 import "unsafe"
 import "errors"
+import "fmt"
+import "sync"
 
 func LinkInJIT()         { C.LLVMLinkInJIT() }
+func LinkInMCJIT()       { C.gollvm_link_in_mcjit() }
 func LinkInInterpreter() { C.LLVMLinkInInterpreter() }
 
 type (
@@ -18,8 +22,148 @@ type (
 	ExecutionEngine struct {
 		C C.LLVMExecutionEngineRef
 	}
+
+	// MCJITCompilerOptions configures an execution engine created by
+	// NewMCJITCompiler.
+	MCJITCompilerOptions struct {
+		OptLevel CodeGenOptLevel
+		// CodeModel defaults to CodeModelJITDefault.
+		CodeModel          CodeModel
+		NoFramePointerElim bool
+		EnableFastISel     bool
+	}
+)
+
+// engineState holds Go-side state associated with an execution engine,
+// which is released when the engine is disposed of.
+type engineState struct {
+	modules     []Module
+	goFuncs     []uintptr
+	mapped      map[Value]bool
+	resolver    SymbolResolver
+	mcjit       bool
+	interpreter bool
+	externals   map[string]ExternalFunction
+}
+
+var (
+	engineStatesMutex sync.Mutex
+	engineStates      = make(map[C.LLVMExecutionEngineRef]*engineState)
 )
 
+// withState calls f with the engine's state, creating it if necessary.
+// The state is locked for the duration of the call.
+func (ee ExecutionEngine) withState(f func(s *engineState)) {
+	engineStatesMutex.Lock()
+	defer engineStatesMutex.Unlock()
+	s := engineStates[ee.C]
+	if s == nil {
+		s = &engineState{}
+		engineStates[ee.C] = s
+	}
+	f(s)
+}
+
+// trackModule records that the engine owns the module.
+func (ee ExecutionEngine) trackModule(m Module) {
+	ee.withState(func(s *engineState) {
+		s.modules = append(s.modules, m)
+	})
+}
+
+// untrackModule records that the engine no longer owns the module.
+func (ee ExecutionEngine) untrackModule(m Module) {
+	ee.withState(func(s *engineState) {
+		for i, owned := range s.modules {
+			if owned == m {
+				s.modules = append(s.modules[:i], s.modules[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+// checkLegacyJIT returns an error if the engine is known to be an
+// interpreter or to use MCJIT, neither of which can run code added to the
+// engine after it was created as native code.
+func (ee ExecutionEngine) checkLegacyJIT() error {
+	var interpreter, mcjit bool
+	ee.withState(func(s *engineState) {
+		interpreter, mcjit = s.interpreter, s.mcjit
+	})
+	switch {
+	case interpreter:
+		return errors.New("not supported by the interpreter")
+	case mcjit:
+		return errors.New("not supported by MCJIT")
+	}
+	return nil
+}
+
+// nativeAddress returns the address of the machine code for fn, compiling
+// it if necessary, or an error if the engine does not generate machine
+// code for functions added after it was created.
+func (ee ExecutionEngine) nativeAddress(fn Value) (unsafe.Pointer, error) {
+	if err := ee.checkLegacyJIT(); err != nil {
+		return nil, err
+	}
+	addr := ee.PointerToGlobal(fn)
+	if addr == unsafe.Pointer(fn.C) {
+		// The interpreter returns functions themselves rather than
+		// machine code.
+		ee.withState(func(s *engineState) { s.interpreter = true })
+		return nil, errors.New("not supported by the interpreter")
+	}
+	return addr, nil
+}
+
+// ownsModule reports whether the engine owns the module.
+func (ee ExecutionEngine) ownsModule(m Module) (owned bool) {
+	ee.withState(func(s *engineState) {
+		for _, mod := range s.modules {
+			if mod == m {
+				owned = true
+				break
+			}
+		}
+	})
+	return
+}
+
+// isOwnedModule reports whether any execution engine owns the module.
+func isOwnedModule(m Module) bool {
+	engineStatesMutex.Lock()
+	defer engineStatesMutex.Unlock()
+	for _, s := range engineStates {
+		for _, owned := range s.modules {
+			if owned == m {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Modules returns the modules owned by the execution engine, in the order
+// they were added.
+func (ee ExecutionEngine) Modules() (modules []Module) {
+	ee.withState(func(s *engineState) {
+		modules = append(modules, s.modules...)
+	})
+	return
+}
+
+// releaseState discards the engine's state.
+func (ee ExecutionEngine) releaseState() {
+	engineStatesMutex.Lock()
+	s := engineStates[ee.C]
+	delete(engineStates, ee.C)
+	engineStatesMutex.Unlock()
+	if s != nil {
+		unregisterGoFuncs(s.goFuncs)
+	}
+}
+
 // helpers
 func llvmGenericValueRefPtr(t *GenericValue) *C.LLVMGenericValueRef {
 	return (*C.LLVMGenericValueRef)(unsafe.Pointer(t))
@@ -57,14 +201,19 @@ func (g GenericValue) Dispose() { C.LLVMDisposeGenericValue(g.C) }
 // llvm.ExecutionEngine
 //-------------------------------------------------------------------------
 
+// NewExecutionEngine creates a JIT compiler for the module if possible, and
+// otherwise an interpreter.
 func NewExecutionEngine(m Module) (ee ExecutionEngine, err error) {
 	var cmsg *C.char
-	fail := C.LLVMCreateExecutionEngineForModule(&ee.C, m.C, &cmsg)
+	var interpreter C.LLVMBool
+	fail := C.gollvm_create_execution_engine_for_module(&ee.C, m.C, &interpreter, &cmsg)
 	if fail != 0 {
 		ee.C = nil
 		err = errors.New(C.GoString(cmsg))
 		C.LLVMDisposeMessage(cmsg)
 	} else {
+		ee.trackModule(m)
+		ee.withState(func(s *engineState) { s.interpreter = interpreter != 0 })
 		err = nil
 	}
 	return
@@ -78,6 +227,8 @@ func NewInterpreter(m Module) (ee ExecutionEngine, err error) {
 		err = errors.New(C.GoString(cmsg))
 		C.LLVMDisposeMessage(cmsg)
 	} else {
+		ee.trackModule(m)
+		ee.withState(func(s *engineState) { s.interpreter = true })
 		err = nil
 	}
 	return
@@ -90,6 +241,35 @@ func NewJITCompiler(m Module, optLevel int) (ee ExecutionEngine, err error) {
 		err = errors.New(C.GoString(cmsg))
 		C.LLVMDisposeMessage(cmsg)
 	} else {
+		ee.trackModule(m)
+		err = nil
+	}
+	return
+}
+
+// NewMCJITCompiler creates an execution engine for the module that uses
+// MCJIT, which generates code with the same machinery as TargetMachine.
+// MCJIT must have been linked in with LinkInMCJIT. The whole module is
+// compiled when the engine is created.
+func NewMCJITCompiler(m Module, options MCJITCompilerOptions) (ee ExecutionEngine, err error) {
+	var cmsg *C.char
+	codeModel := options.CodeModel
+	if codeModel == CodeModelDefault {
+		codeModel = CodeModelJITDefault
+	}
+	fail := C.gollvm_create_mcjit_compiler_for_module(&ee.C, m.C,
+		C.unsigned(options.OptLevel),
+		C.LLVMCodeModel(codeModel),
+		boolToLLVMBool(options.NoFramePointerElim),
+		boolToLLVMBool(options.EnableFastISel),
+		&cmsg)
+	if fail != 0 {
+		ee.C = nil
+		err = errors.New(C.GoString(cmsg))
+		C.LLVMDisposeMessage(cmsg)
+	} else {
+		ee.trackModule(m)
+		ee.withState(func(s *engineState) { s.mcjit = true })
 		err = nil
 	}
 	return
@@ -112,14 +292,45 @@ func NewJITCompiler(m Module, optLevel int) (ee ExecutionEngine, err error) {
 //                               unsigned OptLevel,
 //                               char **OutError);
 
-func (ee ExecutionEngine) Dispose()               { C.LLVMDisposeExecutionEngine(ee.C) }
-func (ee ExecutionEngine) RunStaticConstructors() { C.LLVMRunStaticConstructors(ee.C) }
-func (ee ExecutionEngine) RunStaticDestructors()  { C.LLVMRunStaticDestructors(ee.C) }
+func (ee ExecutionEngine) Dispose() {
+	C.LLVMDisposeExecutionEngine(ee.C)
+	ee.releaseState()
+}
+func (ee ExecutionEngine) RunStaticConstructors() { C.gollvm_run_static_constructors(ee.C) }
+func (ee ExecutionEngine) RunStaticDestructors()  { C.gollvm_run_static_destructors(ee.C) }
+
+// RunFunctionAsMain runs f as if it were a program's main function,
+// passing it args as argv and env as envp, and returns its exit status.
+// args conventionally begins with the program name, as with os.Args; env
+// holds "key=value" strings, as returned by os.Environ.
+func (ee ExecutionEngine) RunFunctionAsMain(f Value, args []string, env []string) int {
+	argv := newCStringArray(args)
+	defer freeCStringArray(argv, len(args))
+	envp := newCStringArray(env)
+	defer freeCStringArray(envp, len(env))
+	return int(C.gollvm_run_function_as_main(ee.C, f.C, C.unsigned(len(args)), argv, envp))
+}
 
-// TODO(nsf): figure out how to convert that stuff from Go's "os.Argv"
-//int LLVMRunFunctionAsMain(LLVMExecutionEngineRef EE, LLVMValueRef F,
-//                          unsigned ArgC, const char * const *ArgV,
-//                          const char * const *EnvP);
+// newCStringArray returns a NULL-terminated, C-allocated copy of strs,
+// which must be released with freeCStringArray.
+func newCStringArray(strs []string) **C.char {
+	ptrSize := unsafe.Sizeof((*C.char)(nil))
+	arr := C.malloc(C.size_t(uintptr(len(strs)+1) * ptrSize))
+	elems := (*[1 << 28]*C.char)(arr)[: len(strs)+1 : len(strs)+1]
+	for i, s := range strs {
+		elems[i] = C.CString(s)
+	}
+	elems[len(strs)] = nil
+	return (**C.char)(arr)
+}
+
+func freeCStringArray(arr **C.char, n int) {
+	elems := (*[1 << 28]*C.char)(unsafe.Pointer(arr))[:n:n]
+	for _, s := range elems {
+		C.free(unsafe.Pointer(s))
+	}
+	C.free(unsafe.Pointer(arr))
+}
 
 func (ee ExecutionEngine) RunFunction(f Value, args []GenericValue) (g GenericValue) {
 	nargs := len(args)
@@ -127,7 +338,7 @@ func (ee ExecutionEngine) RunFunction(f Value, args []GenericValue) (g GenericVa
 	if nargs > 0 {
 		argptr = &args[0]
 	}
-	g.C = C.LLVMRunFunction(ee.C, f.C,
+	g.C = C.gollvm_run_function(ee.C, f.C,
 		C.unsigned(nargs), llvmGenericValueRefPtr(argptr))
 	return
 }
@@ -135,15 +346,56 @@ func (ee ExecutionEngine) RunFunction(f Value, args []GenericValue) (g GenericVa
 func (ee ExecutionEngine) FreeMachineCodeForFunction(f Value) {
 	C.LLVMFreeMachineCodeForFunction(ee.C, f.C)
 }
-func (ee ExecutionEngine) AddModule(m Module) { C.LLVMAddModule(ee.C, m.C) }
+
+// AddModule adds the module to the execution engine, which takes
+// ownership of it. It is an error to add a module that is already owned by
+// an execution engine.
+func (ee ExecutionEngine) AddModule(m Module) error {
+	if isOwnedModule(m) {
+		return errors.New("module is already owned by an execution engine")
+	}
+	ee.addModule(m)
+	return nil
+}
+
+func (ee ExecutionEngine) addModule(m Module) {
+	C.LLVMAddModule(ee.C, m.C)
+	ee.trackModule(m)
+	if r := ee.symbolResolver(); r != nil {
+		ee.resolveSymbols(m, r)
+	}
+}
 
 // XXX(nsf): Don't port deprecated
 // Deprecated: Use LLVMAddModule instead.
 //void LLVMAddModuleProvider(LLVMExecutionEngineRef EE, LLVMModuleProviderRef MP);
 
-func (ee ExecutionEngine) RemoveModule(m Module) {
-	var modtmp C.LLVMModuleRef
-	C.LLVMRemoveModule(ee.C, m.C, &modtmp, nil)
+// RemoveModule removes the module from the execution engine and returns
+// it; ownership passes back to the caller. It is an error to remove a
+// module the engine does not own.
+func (ee ExecutionEngine) RemoveModule(m Module) (mod Module, err error) {
+	if !ee.ownsModule(m) {
+		err = errors.New("module is not owned by the execution engine")
+		return
+	}
+	var cmsg *C.char
+	fail := C.LLVMRemoveModule(ee.C, m.C, &mod.C, &cmsg)
+	if fail != 0 {
+		mod.C = nil
+		err = errors.New(C.GoString(cmsg))
+		C.LLVMDisposeMessage(cmsg)
+		return
+	}
+	ee.untrackModule(m)
+	return
+}
+
+// discardModule removes the module from the execution engine and disposes
+// of it.
+func (ee ExecutionEngine) discardModule(m Module) {
+	if mod, err := ee.RemoveModule(m); err == nil {
+		mod.Dispose()
+	}
 }
 
 // XXX(nsf): Don't port deprecated
@@ -152,10 +404,16 @@ func (ee ExecutionEngine) RemoveModule(m Module) {
 //                                  LLVMModuleProviderRef MP,
 //                                  LLVMModuleRef *OutMod, char **OutError);
 
-func (ee ExecutionEngine) FindFunction(name string) (f Value) {
+// FindFunction returns the named function from the engine's modules, and
+// whether it was found.
+func (ee ExecutionEngine) FindFunction(name string) (f Value, ok bool) {
 	cname := C.CString(name)
-	C.LLVMFindFunction(ee.C, cname, &f.C)
+	notFound := C.LLVMFindFunction(ee.C, cname, &f.C)
 	C.free(unsafe.Pointer(cname))
+	ok = notFound == 0
+	if !ok {
+		f.C = nil
+	}
 	return
 }
 
@@ -163,6 +421,49 @@ func (ee ExecutionEngine) RecompileAndRelinkFunction(f Value) unsafe.Pointer {
 	return C.LLVMRecompileAndRelinkFunction(ee.C, f.C)
 }
 
+// ReplaceFunctionBody replaces the body of old, a function defined by one
+// of the engine's modules, with that of the function of the same name
+// defined by newBody, which must have the same type. newBody is linked
+// into old's module, so any other globals it defines are added to that
+// module, and its declarations are resolved against it; it is left empty,
+// and must still be disposed of by the caller.
+//
+// The function is then recompiled, and the entry point of its previous
+// machine code patched to jump to the new code, so that code already
+// calling it calls the new body. The new address is returned. As the
+// patched entry point remains in use, the previous machine code is not
+// freed. ReplaceFunctionBody is not supported by MCJIT, which compiles
+// whole modules at once, nor by the interpreter, which has no machine code
+// to patch.
+func (ee ExecutionEngine) ReplaceFunctionBody(old Value, newBody Module) (uintptr, error) {
+	if err := ee.checkLegacyJIT(); err != nil {
+		return 0, fmt.Errorf("ReplaceFunctionBody: %v", err)
+	}
+	name := old.Name()
+	if old.IsAFunction().IsNil() || old.IsDeclaration() || !ee.ownsModule(old.GlobalParent()) {
+		return 0, fmt.Errorf("ReplaceFunctionBody: %s is not a function defined by the execution engine", name)
+	}
+	if isOwnedModule(newBody) {
+		return 0, errors.New("ReplaceFunctionBody: new body module is owned by an execution engine")
+	}
+	f := newBody.NamedFunction(name)
+	if f.IsNil() || f.IsDeclaration() {
+		return 0, fmt.Errorf("ReplaceFunctionBody: new body module does not define %s", name)
+	}
+	if f.Type() != old.Type() {
+		return 0, fmt.Errorf("ReplaceFunctionBody: %s: new type %s differs from %s",
+			name, f.Type().ElementType().IRString(), old.Type().ElementType().IRString())
+	}
+
+	var cmsg *C.char
+	if C.gollvm_replace_function_body(old.C, newBody.C, &cmsg) != 0 {
+		err := fmt.Errorf("ReplaceFunctionBody: %s", C.GoString(cmsg))
+		C.LLVMDisposeMessage(cmsg)
+		return 0, err
+	}
+	return uintptr(ee.RecompileAndRelinkFunction(old)), nil
+}
+
 func (ee ExecutionEngine) TargetData() (td TargetData) {
 	td.C = C.LLVMGetExecutionEngineTargetData(ee.C)
 	return
@@ -170,10 +471,47 @@ func (ee ExecutionEngine) TargetData() (td TargetData) {
 
 func (ee ExecutionEngine) AddGlobalMapping(global Value, addr unsafe.Pointer) {
 	C.LLVMAddGlobalMapping(ee.C, global.C, addr)
+	ee.withState(func(s *engineState) {
+		if s.mapped == nil {
+			s.mapped = make(map[Value]bool)
+		}
+		s.mapped[global] = true
+	})
 }
 
 func (ee ExecutionEngine) PointerToGlobal(global Value) unsafe.Pointer {
 	return C.LLVMGetPointerToGlobal(ee.C, global.C)
 }
 
+// GetFunctionAddress returns the address of the compiled code for the
+// named function, compiling it if necessary, or 0 if the engine has no
+// such function.
+func (ee ExecutionEngine) GetFunctionAddress(name string) uintptr {
+	f, ok := ee.FindFunction(name)
+	if !ok {
+		return 0
+	}
+	return uintptr(ee.PointerToGlobal(f))
+}
+
+// GetGlobalValueAddress returns the address of the named global variable,
+// or 0 if none of the engine's modules define it.
+func (ee ExecutionEngine) GetGlobalValueAddress(name string) uintptr {
+	var mcjit bool
+	ee.withState(func(s *engineState) { mcjit = s.mcjit })
+	for _, m := range ee.Modules() {
+		g := m.NamedGlobal(name)
+		if g.IsNil() || g.IsDeclaration() {
+			continue
+		}
+		if mcjit {
+			// PointerToGlobal would return a copy of the variable,
+			// rather than the one used by the compiled code.
+			return uintptr(C.gollvm_get_mcjit_global_value_address(ee.C, g.C))
+		}
+		return uintptr(ee.PointerToGlobal(g))
+	}
+	return 0
+}
+
 // vim: set ft=go:
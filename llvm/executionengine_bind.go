@@ -0,0 +1,256 @@
+package llvm
+
+/*
+#include <stdlib.h>
+
+static void gollvm_call_bound(void *fn, void *frame) {
+	((void (*)(void *))fn)(frame);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// BindFunction sets the Go function variable pointed to by fnPtr to a
+// function that calls the JIT-compiled function with the specified name.
+//
+// The Go function's parameter and result types must correspond to the LLVM
+// function's: bool to i1 or i8; sized integer kinds to integers of the same
+// width; int, uint and uintptr to integers of the native word size; float32
+// and float64 to float and double; unsafe.Pointer to pointer types; and
+// arrays and structs to LLVM arrays and structs whose layout, as described
+// by the execution engine's TargetData, is identical. A void LLVM function
+// corresponds to a Go function with no results.
+//
+// Each call goes through a small wrapper function, compiled into a separate
+// module added to the execution engine, that unpacks the arguments from a
+// frame in C memory, so calls are not subject to GenericValue boxing. As Go
+// pointers may not be stored in C memory, Go pointer types are rejected,
+// and unsafe.Pointer values must not point to Go memory.
+//
+// BindFunction requires an engine created by NewJITCompiler or
+// NewExecutionEngine that is not an interpreter: the interpreter has no
+// machine code to call, and MCJIT does not compile modules added after it
+// is created.
+func (ee ExecutionEngine) BindFunction(name string, fnPtr interface{}) error {
+	if err := ee.checkLegacyJIT(); err != nil {
+		return fmt.Errorf("BindFunction: %v", err)
+	}
+	ptr := reflect.ValueOf(fnPtr)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Func {
+		return fmt.Errorf("BindFunction: expected pointer to func, got %T", fnPtr)
+	}
+	goType := ptr.Elem().Type()
+
+	f, ok := ee.FindFunction(name)
+	if !ok {
+		return fmt.Errorf("BindFunction: function %q not found", name)
+	}
+	fnType := f.Type().ElementType()
+
+	td := ee.TargetData()
+	frameElems, hasResult, err := checkBindSignature(td, goType, fnType)
+	if err != nil {
+		return fmt.Errorf("BindFunction: %s: %v", name, err)
+	}
+	nparams := goType.NumIn()
+
+	// The frame holds the arguments, followed by space for the result.
+	frameType := fnType.Context().StructType(frameElems, false)
+	offsets, frameSize := frameOffsets(td, frameType)
+
+	wrapper := ee.newBindWrapper(f, frameType, nparams, hasResult)
+	wrapperAddr, err := ee.nativeAddress(wrapper)
+	if err != nil {
+		ee.discardModule(wrapper.GlobalParent())
+		return fmt.Errorf("BindFunction: %s: %v", name, err)
+	}
+
+	impl := func(args []reflect.Value) []reflect.Value {
+		frame := C.malloc(C.size_t(frameSize))
+		defer C.free(frame)
+		for i, arg := range args {
+			storeBindValue(unsafe.Pointer(uintptr(frame)+offsets[i]), arg)
+		}
+		C.gollvm_call_bound(wrapperAddr, frame)
+		if !hasResult {
+			return nil
+		}
+		result := reflect.New(goType.Out(0))
+		loadBindValue(result, unsafe.Pointer(uintptr(frame)+offsets[nparams]))
+		return []reflect.Value{result.Elem()}
+	}
+	ptr.Elem().Set(reflect.MakeFunc(goType, impl))
+	return nil
+}
+
+// newBindWrapper creates a module containing a function that loads the
+// arguments for f from a frame of the specified type, calls f, and stores
+// the result in the frame's last element. The module is added to the
+// execution engine.
+func (ee ExecutionEngine) newBindWrapper(f Value, frameType Type, nparams int, hasResult bool) Value {
+	ctx := frameType.Context()
+	m := ctx.NewModule("gollvm.bind." + f.Name())
+
+	// The wrapper's module refers to f by a declaration mapped to its
+	// compiled code, so that f's module is left untouched.
+	decl := AddFunction(m, f.Name(), f.Type().ElementType())
+	decl.SetFunctionCallConv(f.FunctionCallConv())
+	ee.AddGlobalMapping(decl, ee.PointerToGlobal(f))
+
+	wrapperType := FunctionType(ctx.VoidType(), []Type{PointerType(frameType, 0)}, false)
+	wrapper := AddFunction(m, f.Name()+".gowrapper", wrapperType)
+	b := ctx.NewBuilder()
+	defer b.Dispose()
+	b.SetInsertPointAtEnd(ctx.AddBasicBlock(wrapper, "entry"))
+	frame := wrapper.Param(0)
+	args := make([]Value, nparams)
+	for i := range args {
+		args[i] = b.CreateLoad(b.CreateStructGEP(frame, i, ""), "")
+	}
+	result := b.CreateCall(decl, args, "")
+	result.SetInstructionCallConv(f.FunctionCallConv())
+	if hasResult {
+		b.CreateStore(result, b.CreateStructGEP(frame, nparams, ""))
+	}
+	b.CreateRetVoid()
+
+	ee.addModule(m)
+	return wrapper
+}
+
+// checkBindSignature checks that the Go function type corresponds to the
+// LLVM function type, and returns the element types of the frame used to
+// pass arguments and the result between Go and native code.
+func checkBindSignature(td TargetData, goType reflect.Type, fnType Type) (frameElems []Type, hasResult bool, err error) {
+	if goType.IsVariadic() {
+		return nil, false, errors.New("variadic Go functions are not supported")
+	}
+	if fnType.IsFunctionVarArg() {
+		return nil, false, errors.New("variadic LLVM functions are not supported")
+	}
+	params := fnType.ParamTypes()
+	if len(params) != goType.NumIn() {
+		return nil, false, fmt.Errorf("have %d parameters, Go function has %d",
+			len(params), goType.NumIn())
+	}
+	for i, p := range params {
+		if err := checkBindType(td, goType.In(i), p); err != nil {
+			return nil, false, fmt.Errorf("parameter %d: %v", i, err)
+		}
+	}
+	frameElems = params
+	ret := fnType.ReturnType()
+	hasResult = ret.TypeKind() != VoidTypeKind
+	if hasResult {
+		if goType.NumOut() != 1 {
+			return nil, false, fmt.Errorf("Go function must have one result")
+		}
+		if err := checkBindType(td, goType.Out(0), ret); err != nil {
+			return nil, false, fmt.Errorf("result: %v", err)
+		}
+		frameElems = append(frameElems, ret)
+	} else if goType.NumOut() != 0 {
+		return nil, false, fmt.Errorf("Go function must have no results")
+	}
+	return frameElems, hasResult, nil
+}
+
+// frameOffsets returns the byte offsets of the elements of a frame type,
+// and the frame's size, which is at least one byte.
+func frameOffsets(td TargetData, frameType Type) (offsets []uintptr, size uint64) {
+	offsets = make([]uintptr, frameType.StructElementTypesCount())
+	for i := range offsets {
+		offsets[i] = uintptr(td.ElementOffset(frameType, i))
+	}
+	size = td.TypeAllocSize(frameType)
+	if size == 0 {
+		size = 1
+	}
+	return offsets, size
+}
+
+// checkBindType checks that values of the Go type have the same in-memory
+// representation as values of the LLVM type.
+func checkBindType(td TargetData, gt reflect.Type, lt Type) error {
+	mismatch := fmt.Errorf("cannot use Go type %v as %s", gt, lt.IRString())
+	switch gt.Kind() {
+	case reflect.Bool:
+		if lt.TypeKind() != IntegerTypeKind || (lt.IntTypeWidth() != 1 && lt.IntTypeWidth() != 8) {
+			return mismatch
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		if lt.TypeKind() != IntegerTypeKind || lt.IntTypeWidth() != int(gt.Size()*8) {
+			return mismatch
+		}
+	case reflect.Float32:
+		if lt.TypeKind() != FloatTypeKind {
+			return mismatch
+		}
+	case reflect.Float64:
+		if lt.TypeKind() != DoubleTypeKind {
+			return mismatch
+		}
+	case reflect.UnsafePointer:
+		if lt.TypeKind() != PointerTypeKind {
+			return mismatch
+		}
+	case reflect.Ptr:
+		// Values are copied to and from memory not managed by Go, where
+		// cgo does not permit Go pointers to be stored.
+		return fmt.Errorf("Go pointer type %v is not supported; use unsafe.Pointer or uintptr", gt)
+	case reflect.Array:
+		if lt.TypeKind() != ArrayTypeKind || lt.ArrayLength() != gt.Len() {
+			return mismatch
+		}
+		if err := checkBindType(td, gt.Elem(), lt.ElementType()); err != nil {
+			return err
+		}
+	case reflect.Struct:
+		if lt.TypeKind() != StructTypeKind || lt.StructElementTypesCount() != gt.NumField() {
+			return mismatch
+		}
+		for i, et := range lt.StructElementTypes() {
+			field := gt.Field(i)
+			if td.ElementOffset(lt, i) != uint64(field.Offset) {
+				return fmt.Errorf("field %s of %v is not at the same offset as element %d of %s",
+					field.Name, gt, i, lt.IRString())
+			}
+			if err := checkBindType(td, field.Type, et); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported Go type %v", gt)
+	}
+	if td.TypeAllocSize(lt) != uint64(gt.Size()) {
+		return mismatch
+	}
+	return nil
+}
+
+// storeBindValue copies the in-memory representation of v to dst.
+func storeBindValue(dst unsafe.Pointer, v reflect.Value) {
+	tmp := reflect.New(v.Type())
+	tmp.Elem().Set(v)
+	copyBindBytes(dst, unsafe.Pointer(tmp.Pointer()), v.Type().Size())
+}
+
+// loadBindValue copies the value at src to the value pointed to by ptr.
+func loadBindValue(ptr reflect.Value, src unsafe.Pointer) {
+	copyBindBytes(unsafe.Pointer(ptr.Pointer()), src, ptr.Type().Elem().Size())
+}
+
+func copyBindBytes(dst, src unsafe.Pointer, n uintptr) {
+	if n == 0 {
+		return
+	}
+	copy((*[1 << 30]byte)(dst)[:n:n], (*[1 << 30]byte)(src)[:n:n])
+}
@@ -0,0 +1,88 @@
+package llvm
+
+/*
+#include "backports.h"
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// ExternalFunction implements a function that is declared but not defined
+// by the modules of an interpreter. It is called with the arguments of
+// each call, and returns the call's result, or a zero GenericValue if the
+// function returns void.
+//
+// The arguments are disposed of when the function returns, and must not
+// be retained. The result is disposed of by the interpreter.
+type ExternalFunction func(args []GenericValue) GenericValue
+
+// externalsMutex serializes calls to gollvm_register_external_function.
+var externalsMutex sync.Mutex
+
+// RegisterExternalFunction makes fn the implementation of the named
+// external function for code run by the interpreter, which must have been
+// created with NewInterpreter, or by NewExecutionEngine when no JIT is
+// available. Registering a name again replaces its implementation. fn must
+// not panic, as panics cannot unwind through the interpreter.
+//
+// Functions the interpreter implements itself, such as printf and exit,
+// cannot be replaced. At most 256 distinct names may be registered per
+// process.
+func (ee ExecutionEngine) RegisterExternalFunction(name string, fn ExternalFunction) error {
+	var interpreter bool
+	ee.withState(func(s *engineState) { interpreter = s.interpreter })
+	if !interpreter {
+		return errors.New("RegisterExternalFunction: execution engine is not an interpreter")
+	}
+
+	cname := C.CString(name)
+	externalsMutex.Lock()
+	slot := C.gollvm_register_external_function(cname)
+	externalsMutex.Unlock()
+	C.free(unsafe.Pointer(cname))
+	if slot < 0 {
+		return fmt.Errorf("RegisterExternalFunction: %s: too many external functions", name)
+	}
+
+	ee.withState(func(s *engineState) {
+		if s.externals == nil {
+			s.externals = make(map[string]ExternalFunction)
+		}
+		s.externals[name] = fn
+	})
+	return nil
+}
+
+// lookupExternalFunction returns the named function registered with the
+// engine, or nil if there is none.
+func lookupExternalFunction(ee C.LLVMExecutionEngineRef, name string) ExternalFunction {
+	engineStatesMutex.Lock()
+	defer engineStatesMutex.Unlock()
+	if s := engineStates[ee]; s != nil {
+		return s.externals[name]
+	}
+	return nil
+}
+
+//export gollvmCallExternalFunction
+func gollvmCallExternalFunction(ee C.LLVMExecutionEngineRef, name *C.char, nargs C.unsigned, args *C.LLVMGenericValueRef, result *C.LLVMGenericValueRef) C.int {
+	fn := lookupExternalFunction(ee, C.GoString(name))
+	if fn == nil {
+		return 0
+	}
+	goArgs := make([]GenericValue, int(nargs))
+	if nargs > 0 {
+		cargs := (*[1 << 28]C.LLVMGenericValueRef)(unsafe.Pointer(args))[:nargs:nargs]
+		for i, arg := range cargs {
+			goArgs[i].C = arg
+		}
+	}
+	*result = fn(goArgs).C
+	return 1
+}
@@ -0,0 +1,151 @@
+package llvm
+
+/*
+#include <stdint.h>
+
+extern void gollvmCallGoFunction(uintptr_t id, void *frame);
+*/
+import "C"
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// goFunc is a Go function registered with RegisterGoFunction.
+type goFunc struct {
+	fn      reflect.Value
+	offsets []uintptr
+}
+
+var (
+	goFuncsMutex sync.Mutex
+	goFuncs      = make(map[uintptr]*goFunc)
+	goFuncNextID uintptr
+)
+
+func registerGoFunc(f *goFunc) uintptr {
+	goFuncsMutex.Lock()
+	defer goFuncsMutex.Unlock()
+	goFuncNextID++
+	goFuncs[goFuncNextID] = f
+	return goFuncNextID
+}
+
+func unregisterGoFuncs(ids []uintptr) {
+	goFuncsMutex.Lock()
+	defer goFuncsMutex.Unlock()
+	for _, id := range ids {
+		delete(goFuncs, id)
+	}
+}
+
+// RegisterGoFunction makes the Go function fn the implementation of the
+// function declaration decl, so that JIT-compiled code calling decl calls
+// fn. The parameter and result types of fn must correspond to those of
+// decl, as described for BindFunction.
+//
+// Code calling decl must not have been compiled before RegisterGoFunction
+// is called. fn must not panic, as panics cannot unwind through native
+// code. The registration is released when the execution engine is
+// disposed of. As for BindFunction, the engine must be neither an
+// interpreter nor MCJIT; for the interpreter, see RegisterExternalFunction.
+func (ee ExecutionEngine) RegisterGoFunction(decl Value, fn interface{}) error {
+	if err := ee.checkLegacyJIT(); err != nil {
+		return fmt.Errorf("RegisterGoFunction: %v", err)
+	}
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return fmt.Errorf("RegisterGoFunction: expected func, got %T", fn)
+	}
+	goType := fv.Type()
+	name := decl.Name()
+	if decl.IsAFunction().IsNil() || !decl.IsDeclaration() {
+		return fmt.Errorf("RegisterGoFunction: %s is not a function declaration", name)
+	}
+	fnType := decl.Type().ElementType()
+
+	td := ee.TargetData()
+	frameElems, _, err := checkBindSignature(td, goType, fnType)
+	if err != nil {
+		return fmt.Errorf("RegisterGoFunction: %s: %v", name, err)
+	}
+	frameType := fnType.Context().StructType(frameElems, false)
+	offsets, _ := frameOffsets(td, frameType)
+
+	id := registerGoFunc(&goFunc{fn: fv, offsets: offsets})
+	trampoline := ee.newGoFuncTrampoline(decl, frameType, id)
+	addr, err := ee.nativeAddress(trampoline)
+	if err != nil {
+		ee.discardModule(trampoline.GlobalParent())
+		unregisterGoFuncs([]uintptr{id})
+		return fmt.Errorf("RegisterGoFunction: %s: %v", name, err)
+	}
+	ee.withState(func(s *engineState) {
+		s.goFuncs = append(s.goFuncs, id)
+	})
+	ee.AddGlobalMapping(decl, addr)
+	return nil
+}
+
+// newGoFuncTrampoline creates a module containing a function with the same
+// signature as decl, which stores its arguments in a frame of the
+// specified type and passes the frame to the Go function registered under
+// id. The module is added to the execution engine.
+func (ee ExecutionEngine) newGoFuncTrampoline(decl Value, frameType Type, id uintptr) Value {
+	ctx := frameType.Context()
+	name := decl.Name()
+	m := ctx.NewModule("gollvm.gofunc." + name)
+
+	idType := ctx.Int64Type()
+	if ee.TargetData().PointerSize() == 4 {
+		idType = ctx.Int32Type()
+	}
+	i8ptr := PointerType(ctx.Int8Type(), 0)
+	callbackType := FunctionType(ctx.VoidType(), []Type{idType, i8ptr}, false)
+	callback := AddFunction(m, "gollvmCallGoFunction", callbackType)
+	ee.AddGlobalMapping(callback, unsafe.Pointer(C.gollvmCallGoFunction))
+
+	fnType := decl.Type().ElementType()
+	trampoline := AddFunction(m, name+".gotrampoline", fnType)
+	trampoline.SetFunctionCallConv(decl.FunctionCallConv())
+	b := ctx.NewBuilder()
+	defer b.Dispose()
+	b.SetInsertPointAtEnd(ctx.AddBasicBlock(trampoline, "entry"))
+	frame := b.CreateAlloca(frameType, "frame")
+	params := trampoline.Params()
+	for i, param := range params {
+		b.CreateStore(param, b.CreateStructGEP(frame, i, ""))
+	}
+	idValue := ConstInt(idType, uint64(id), false)
+	b.CreateCall(callback, []Value{idValue, b.CreateBitCast(frame, i8ptr, "")}, "")
+	if fnType.ReturnType().TypeKind() == VoidTypeKind {
+		b.CreateRetVoid()
+	} else {
+		b.CreateRet(b.CreateLoad(b.CreateStructGEP(frame, len(params), ""), ""))
+	}
+
+	ee.addModule(m)
+	return trampoline
+}
+
+//export gollvmCallGoFunction
+func gollvmCallGoFunction(id C.uintptr_t, frame unsafe.Pointer) {
+	goFuncsMutex.Lock()
+	f := goFuncs[uintptr(id)]
+	goFuncsMutex.Unlock()
+
+	fnType := f.fn.Type()
+	args := make([]reflect.Value, fnType.NumIn())
+	for i := range args {
+		arg := reflect.New(fnType.In(i))
+		loadBindValue(arg, unsafe.Pointer(uintptr(frame)+f.offsets[i]))
+		args[i] = arg.Elem()
+	}
+	results := f.fn.Call(args)
+	if len(results) > 0 {
+		storeBindValue(unsafe.Pointer(uintptr(frame)+f.offsets[len(args)]), results[0])
+	}
+}
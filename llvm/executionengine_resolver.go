@@ -0,0 +1,126 @@
+package llvm
+
+/*
+#include <stdlib.h>
+#include "backports.h"
+*/
+import "C"
+
+import (
+	"strings"
+	"unsafe"
+)
+
+// SymbolResolver returns the address of the named external symbol, and
+// whether it knows of the symbol.
+type SymbolResolver func(name string) (addr uintptr, ok bool)
+
+// UnresolvedSymbolsError is returned by ExecutionEngine.ResolveSymbols if
+// any external symbols could not be resolved.
+type UnresolvedSymbolsError struct {
+	Names []string
+}
+
+func (e *UnresolvedSymbolsError) Error() string {
+	return "unresolved external symbols: " + strings.Join(e.Names, ", ")
+}
+
+// SetSymbolResolver sets a function that is consulted, before the default
+// lookup in the process and loaded libraries, for the address of each
+// global value that is declared but not defined by the engine's modules.
+// The resolver is applied immediately to the engine's existing modules,
+// and to each module subsequently added with AddModule, by adding global
+// mappings for the symbols it resolves; it must therefore be set before
+// code using those symbols is compiled. As MCJIT compiles its module when
+// it is created, the resolver only applies to modules added to an MCJIT
+// engine later.
+func (ee ExecutionEngine) SetSymbolResolver(r SymbolResolver) {
+	var modules []Module
+	ee.withState(func(s *engineState) {
+		s.resolver = r
+		modules = append(modules, s.modules...)
+	})
+	if r != nil {
+		for _, m := range modules {
+			ee.resolveSymbols(m, r)
+		}
+	}
+}
+
+func (ee ExecutionEngine) symbolResolver() (r SymbolResolver) {
+	ee.withState(func(s *engineState) { r = s.resolver })
+	return
+}
+
+// ResolveSymbols checks that every external symbol referenced by the
+// engine's modules can be resolved, by a global mapping, the symbol
+// resolver or the default lookup. If not, it returns an
+// *UnresolvedSymbolsError naming the symbols that could not be, rather
+// than leaving the engine to abort when they are first used.
+func (ee ExecutionEngine) ResolveSymbols() error {
+	r := ee.symbolResolver()
+	var unresolved []string
+	for _, m := range ee.Modules() {
+		unresolved = append(unresolved, ee.resolveSymbols(m, r)...)
+	}
+	if len(unresolved) > 0 {
+		return &UnresolvedSymbolsError{unresolved}
+	}
+	return nil
+}
+
+// resolveSymbols adds global mappings for the module's external symbols
+// that the resolver knows of, and returns the names of those that neither
+// it nor the default lookup know of.
+func (ee ExecutionEngine) resolveSymbols(m Module, r SymbolResolver) (unresolved []string) {
+	var decls []Value
+	for f := m.FirstFunction(); !f.IsNil(); f = NextFunction(f) {
+		if f.IsDeclaration() && !strings.HasPrefix(f.Name(), "llvm.") {
+			decls = append(decls, f)
+		}
+	}
+	for g := m.FirstGlobal(); !g.IsNil(); g = NextGlobal(g) {
+		if g.IsDeclaration() {
+			decls = append(decls, g)
+		}
+	}
+
+	for _, decl := range decls {
+		name := decl.Name()
+		if ee.isMapped(decl) || ee.isDefined(name) {
+			continue
+		}
+		if r != nil {
+			if addr, ok := r(name); ok {
+				ee.AddGlobalMapping(decl, C.gollvm_uintptr_to_pointer(C.uintptr_t(addr)))
+				continue
+			}
+		}
+		cname := C.CString(name)
+		addr := C.gollvm_search_for_address_of_symbol(cname)
+		C.free(unsafe.Pointer(cname))
+		if addr == nil {
+			unresolved = append(unresolved, name)
+		}
+	}
+	return unresolved
+}
+
+func (ee ExecutionEngine) isMapped(global Value) (mapped bool) {
+	ee.withState(func(s *engineState) { mapped = s.mapped[global] })
+	return
+}
+
+// isDefined reports whether one of the engine's modules defines the named
+// global value.
+func (ee ExecutionEngine) isDefined(name string) bool {
+	for _, m := range ee.Modules() {
+		if f := m.NamedFunction(name); !f.IsNil() && !f.IsDeclaration() {
+			return true
+		}
+		if g := m.NamedGlobal(name); !g.IsNil() && !g.IsDeclaration() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,470 @@
+package llvm
+
+/*
+#include <stdlib.h>
+#include "backports.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"unsafe"
+)
+
+var bigIntType = reflect.TypeOf((*big.Int)(nil))
+
+// GenericValueOf returns a GenericValue holding v as a value of type t,
+// which must be an integer, floating point or pointer type.
+//
+// Integer values may be given as any Go integer type, bool or *big.Int,
+// and must be representable in t as either a signed or unsigned integer.
+// Floating point values may be given as float32 or float64. Pointer values
+// may be given as unsafe.Pointer, uintptr or any Go pointer; Go pointers
+// are subject to the same rules as pointers passed to C code by cgo.
+//
+// For aggregate and vector types, see TargetData.GenericValueOf.
+func GenericValueOf(t Type, v interface{}) (g GenericValue, err error) {
+	rv := reflect.ValueOf(v)
+	switch t.TypeKind() {
+	case IntegerTypeKind:
+		x, err := bigIntOf(rv)
+		if err != nil {
+			return g, fmt.Errorf("GenericValueOf: %v", err)
+		}
+		width := t.IntTypeWidth()
+		if !intFitsWidth(x, width) {
+			return g, fmt.Errorf("GenericValueOf: %v overflows %s", x, t.IRString())
+		}
+		words := intWords(x, width)
+		g.C = C.gollvm_create_generic_value_of_words(t.C,
+			C.unsigned(len(words)), (*C.uint64_t)(unsafe.Pointer(&words[0])))
+	case FloatTypeKind, DoubleTypeKind:
+		switch rv.Kind() {
+		case reflect.Float32, reflect.Float64:
+			g = NewGenericValueFromFloat(t, rv.Float())
+		default:
+			return g, fmt.Errorf("GenericValueOf: cannot use %T as %s", v, t.IRString())
+		}
+	case PointerTypeKind:
+		switch rv.Kind() {
+		case reflect.Ptr, reflect.UnsafePointer:
+			g = NewGenericValueFromPointer(unsafe.Pointer(rv.Pointer()))
+		case reflect.Uintptr:
+			g = NewGenericValueFromPointer(C.gollvm_uintptr_to_pointer(C.uintptr_t(rv.Uint())))
+		default:
+			return g, fmt.Errorf("GenericValueOf: cannot use %T as %s", v, t.IRString())
+		}
+	default:
+		return g, fmt.Errorf("GenericValueOf: unsupported type %s", t.IRString())
+	}
+	return g, nil
+}
+
+// Into stores the value held by g, which is of type t, in the variable
+// pointed to by dst. t must be an integer, floating point or pointer type.
+//
+// Integer values may be stored in Go integer variables at least as wide as
+// t, in which case they are sign extended if the variable is of a signed
+// type; in bool variables; or in *big.Int variables, in which case they
+// are interpreted as signed. Floating point values may be stored in
+// float32 or float64 variables, and pointer values in unsafe.Pointer or
+// uintptr variables.
+//
+// For aggregate and vector types, see TargetData.GenericValueInto.
+func (g GenericValue) Into(t Type, dst interface{}) error {
+	d, err := settableElem(dst)
+	if err != nil {
+		return fmt.Errorf("Into: %v", err)
+	}
+	switch t.TypeKind() {
+	case IntegerTypeKind:
+		width := t.IntTypeWidth()
+		words := make([]uint64, (width+63)/64)
+		C.gollvm_generic_value_to_words(g.C,
+			C.unsigned(len(words)), (*C.uint64_t)(unsafe.Pointer(&words[0])))
+		x := new(big.Int)
+		for i := len(words) - 1; i >= 0; i-- {
+			x.Lsh(x, 64)
+			x.Or(x, new(big.Int).SetUint64(words[i]))
+		}
+		err = setInt(d, x, width)
+	case FloatTypeKind, DoubleTypeKind:
+		err = setFloat(d, g.Float(t))
+	case PointerTypeKind:
+		err = setPointer(d, uintptr(g.Pointer()))
+	default:
+		err = fmt.Errorf("unsupported type %s", t.IRString())
+	}
+	if err != nil {
+		return fmt.Errorf("Into: %v", err)
+	}
+	return nil
+}
+
+// GenericValueOf is like the package-level GenericValueOf, but also
+// accepts aggregate and vector types. Values of these types are laid out
+// in C-allocated memory as described by td, and the returned GenericValue
+// holds a pointer to that memory. It is therefore suitable as the argument
+// for a parameter of pointer to t type, that is, for passing aggregates by
+// reference; the execution engines cannot pass aggregates by value through
+// RunFunction. Such GenericValues must be disposed of with
+// DisposeAggregate.
+//
+// Struct values may be given as Go structs with the same number of fields,
+// and array and vector values as Go arrays or slices of the same length,
+// whose elements are converted as for GenericValueOf, except that Go
+// pointers, which cgo does not permit to be stored in C memory, are not
+// accepted.
+func (td TargetData) GenericValueOf(t Type, v interface{}) (g GenericValue, err error) {
+	if !isAggregateType(t) {
+		return GenericValueOf(t, v)
+	}
+	size := td.TypeAllocSize(t)
+	mem := C.calloc(1, C.size_t(size)+1)
+	if err := td.storeValue(memBytes(mem, size), t, reflect.ValueOf(v)); err != nil {
+		C.free(mem)
+		return g, fmt.Errorf("GenericValueOf: %v", err)
+	}
+	return NewGenericValueFromPointer(mem), nil
+}
+
+// GenericValueInto is like GenericValue.Into, but also accepts aggregate
+// and vector types, whose values are read from the memory g points to, as
+// laid out by td; g is typically a GenericValue created by GenericValueOf
+// and passed by reference to a function that filled it in. Aggregate
+// values may be stored in Go structs with the same number of fields, all
+// exported, and array and vector values in Go arrays of the same length or
+// in slices, which are resized as necessary.
+func (td TargetData) GenericValueInto(g GenericValue, t Type, dst interface{}) error {
+	if !isAggregateType(t) {
+		return g.Into(t, dst)
+	}
+	d, err := settableElem(dst)
+	if err == nil {
+		err = td.loadValue(memBytes(g.Pointer(), td.TypeAllocSize(t)), t, d)
+	}
+	if err != nil {
+		return fmt.Errorf("GenericValueInto: %v", err)
+	}
+	return nil
+}
+
+// DisposeAggregate disposes of a GenericValue created for an aggregate or
+// vector type by TargetData.GenericValueOf, and the memory it points to.
+func (g GenericValue) DisposeAggregate() {
+	C.free(g.Pointer())
+	g.Dispose()
+}
+
+func isAggregateType(t Type) bool {
+	switch t.TypeKind() {
+	case StructTypeKind, ArrayTypeKind, VectorTypeKind:
+		return true
+	}
+	return false
+}
+
+func memBytes(p unsafe.Pointer, size uint64) []byte {
+	if size == 0 {
+		return nil
+	}
+	return (*[1 << 30]byte)(p)[:size:size]
+}
+
+func settableElem(dst interface{}) (reflect.Value, error) {
+	p := reflect.ValueOf(dst)
+	if p.Kind() != reflect.Ptr || p.IsNil() {
+		return reflect.Value{}, fmt.Errorf("expected non-nil pointer, got %T", dst)
+	}
+	return p.Elem(), nil
+}
+
+// bigIntOf returns the integer held by v.
+func bigIntOf(v reflect.Value) (*big.Int, error) {
+	if !v.IsValid() {
+		return nil, fmt.Errorf("cannot use nil as an integer")
+	}
+	if v.Type() == bigIntType {
+		if v.IsNil() {
+			return nil, fmt.Errorf("nil *big.Int")
+		}
+		return new(big.Int).Set(v.Interface().(*big.Int)), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return big.NewInt(1), nil
+		}
+		return big.NewInt(0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return big.NewInt(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return new(big.Int).SetUint64(v.Uint()), nil
+	}
+	return nil, fmt.Errorf("cannot use %v as an integer", v.Type())
+}
+
+// valueTypeString returns the type of v for use in error messages, which
+// is "nil" if v is the zero Value.
+func valueTypeString(v reflect.Value) string {
+	if !v.IsValid() {
+		return "nil"
+	}
+	return v.Type().String()
+}
+
+// intFitsWidth reports whether x is representable as a signed or unsigned
+// integer of the specified width.
+func intFitsWidth(x *big.Int, width int) bool {
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(width))
+	min := new(big.Int).Neg(new(big.Int).Rsh(limit, 1))
+	return x.Cmp(min) >= 0 && x.Cmp(limit) < 0
+}
+
+// intWords returns the two's complement representation of x, truncated to
+// the specified width, as 64-bit words, least significant first.
+func intWords(x *big.Int, width int) []uint64 {
+	y := new(big.Int).Mod(x, new(big.Int).Lsh(big.NewInt(1), uint(width)))
+	mask := new(big.Int).SetUint64(math.MaxUint64)
+	words := make([]uint64, (width+63)/64)
+	for i := range words {
+		words[i] = new(big.Int).And(y, mask).Uint64()
+		y.Rsh(y, 64)
+	}
+	return words
+}
+
+// setInt stores x, an unsigned integer of the specified width, in d.
+func setInt(d reflect.Value, x *big.Int, width int) error {
+	if d.Type() == bigIntType {
+		if x.Bit(width-1) != 0 {
+			x.Sub(x, new(big.Int).Lsh(big.NewInt(1), uint(width)))
+		}
+		d.Set(reflect.ValueOf(x))
+		return nil
+	}
+	switch d.Kind() {
+	case reflect.Bool:
+		d.SetBool(x.Sign() != 0)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if width > d.Type().Bits() {
+			break
+		}
+		shift := uint(64 - width)
+		d.SetInt(int64(x.Uint64()<<shift) >> shift)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if width > d.Type().Bits() {
+			break
+		}
+		d.SetUint(x.Uint64())
+		return nil
+	}
+	return fmt.Errorf("cannot store i%d in %v", width, d.Type())
+}
+
+func setFloat(d reflect.Value, f float64) error {
+	switch d.Kind() {
+	case reflect.Float32, reflect.Float64:
+		d.SetFloat(f)
+		return nil
+	}
+	return fmt.Errorf("cannot store floating point value in %v", d.Type())
+}
+
+func setPointer(d reflect.Value, p uintptr) error {
+	switch d.Kind() {
+	case reflect.UnsafePointer:
+		d.SetPointer(C.gollvm_uintptr_to_pointer(C.uintptr_t(p)))
+		return nil
+	case reflect.Uintptr:
+		d.SetUint(uint64(p))
+		return nil
+	}
+	return fmt.Errorf("cannot store pointer in %v", d.Type())
+}
+
+// putUint stores the unsigned integer x in mem in the target's byte order.
+func (td TargetData) putUint(mem []byte, x *big.Int) {
+	b := x.Bytes()
+	for i := range mem {
+		var v byte
+		if i < len(b) {
+			v = b[len(b)-1-i]
+		}
+		if td.ByteOrder() == LittleEndian {
+			mem[i] = v
+		} else {
+			mem[len(mem)-1-i] = v
+		}
+	}
+}
+
+// getUint loads an unsigned integer from mem in the target's byte order.
+func (td TargetData) getUint(mem []byte) *big.Int {
+	b := make([]byte, len(mem))
+	for i := range mem {
+		if td.ByteOrder() == LittleEndian {
+			b[len(b)-1-i] = mem[i]
+		} else {
+			b[i] = mem[i]
+		}
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+// elementStride returns the distance in bytes between consecutive elements
+// of an array or vector type.
+func (td TargetData) elementStride(t Type) (uint64, error) {
+	elem := t.ElementType()
+	if t.TypeKind() == ArrayTypeKind {
+		return td.TypeAllocSize(elem), nil
+	}
+	// Vector elements are packed without padding.
+	bits := td.TypeSizeInBits(elem)
+	if bits%8 != 0 {
+		return 0, fmt.Errorf("unsupported vector type %s", t.IRString())
+	}
+	return bits / 8, nil
+}
+
+func sequenceLength(t Type) int {
+	if t.TypeKind() == ArrayTypeKind {
+		return t.ArrayLength()
+	}
+	return t.VectorSize()
+}
+
+// storeValue stores v in mem as a value of type t.
+func (td TargetData) storeValue(mem []byte, t Type, v reflect.Value) error {
+	if v.Kind() == reflect.Interface {
+		// Fields and elements of interface type hold the value to store.
+		v = v.Elem()
+	}
+	switch t.TypeKind() {
+	case IntegerTypeKind:
+		x, err := bigIntOf(v)
+		if err != nil {
+			return err
+		}
+		width := t.IntTypeWidth()
+		if !intFitsWidth(x, width) {
+			return fmt.Errorf("%v overflows %s", x, t.IRString())
+		}
+		x.Mod(x, new(big.Int).Lsh(big.NewInt(1), uint(width)))
+		td.putUint(mem[:td.TypeStoreSize(t)], x)
+	case FloatTypeKind, DoubleTypeKind:
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return fmt.Errorf("cannot use %s as %s", valueTypeString(v), t.IRString())
+		}
+		var bits uint64
+		if t.TypeKind() == FloatTypeKind {
+			bits = uint64(math.Float32bits(float32(v.Float())))
+		} else {
+			bits = math.Float64bits(v.Float())
+		}
+		td.putUint(mem[:td.TypeStoreSize(t)], new(big.Int).SetUint64(bits))
+	case PointerTypeKind:
+		var p uint64
+		switch v.Kind() {
+		case reflect.UnsafePointer:
+			p = uint64(v.Pointer())
+		case reflect.Uintptr:
+			p = v.Uint()
+		default:
+			return fmt.Errorf("cannot use %s as %s", valueTypeString(v), t.IRString())
+		}
+		td.putUint(mem[:td.PointerSize()], new(big.Int).SetUint64(p))
+	case StructTypeKind:
+		elems := t.StructElementTypes()
+		if v.Kind() != reflect.Struct || v.NumField() != len(elems) {
+			return fmt.Errorf("cannot use %s as %s", valueTypeString(v), t.IRString())
+		}
+		for i, et := range elems {
+			off := td.ElementOffset(t, i)
+			if err := td.storeValue(mem[off:], et, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case ArrayTypeKind, VectorTypeKind:
+		n := sequenceLength(t)
+		if v.Kind() != reflect.Array && v.Kind() != reflect.Slice {
+			return fmt.Errorf("cannot use %s as %s", valueTypeString(v), t.IRString())
+		}
+		if v.Len() != n {
+			return fmt.Errorf("cannot use %v of length %d as %s", v.Type(), v.Len(), t.IRString())
+		}
+		stride, err := td.elementStride(t)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := td.storeValue(mem[uint64(i)*stride:], t.ElementType(), v.Index(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", t.IRString())
+	}
+	return nil
+}
+
+// loadValue loads a value of type t from mem into d.
+func (td TargetData) loadValue(mem []byte, t Type, d reflect.Value) error {
+	if !d.CanSet() {
+		return fmt.Errorf("cannot store %s in unexported field", t.IRString())
+	}
+	switch t.TypeKind() {
+	case IntegerTypeKind:
+		width := t.IntTypeWidth()
+		x := td.getUint(mem[:td.TypeStoreSize(t)])
+		x.And(x, new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(width)), big.NewInt(1)))
+		return setInt(d, x, width)
+	case FloatTypeKind:
+		bits := td.getUint(mem[:4]).Uint64()
+		return setFloat(d, float64(math.Float32frombits(uint32(bits))))
+	case DoubleTypeKind:
+		bits := td.getUint(mem[:8]).Uint64()
+		return setFloat(d, math.Float64frombits(bits))
+	case PointerTypeKind:
+		p := td.getUint(mem[:td.PointerSize()]).Uint64()
+		return setPointer(d, uintptr(p))
+	case StructTypeKind:
+		elems := t.StructElementTypes()
+		if d.Kind() != reflect.Struct || d.NumField() != len(elems) {
+			return fmt.Errorf("cannot store %s in %v", t.IRString(), d.Type())
+		}
+		for i, et := range elems {
+			off := td.ElementOffset(t, i)
+			if err := td.loadValue(mem[off:], et, d.Field(i)); err != nil {
+				return err
+			}
+		}
+	case ArrayTypeKind, VectorTypeKind:
+		n := sequenceLength(t)
+		switch {
+		case d.Kind() == reflect.Slice:
+			if d.Len() != n {
+				d.Set(reflect.MakeSlice(d.Type(), n, n))
+			}
+		case d.Kind() != reflect.Array || d.Len() != n:
+			return fmt.Errorf("cannot store %s in %v", t.IRString(), d.Type())
+		}
+		stride, err := td.elementStride(t)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := td.loadValue(mem[uint64(i)*stride:], t.ElementType(), d.Index(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", t.IRString())
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package llvm
+
+/*
+#include <stdlib.h>
+#include "backports.h"
+*/
+import "C"
+import "fmt"
+import "io/ioutil"
+import "unsafe"
+
+// IRParseError describes a syntax or semantic error found by ParseIR.
+type IRParseError struct {
+	Name string
+	// Line and Column are 1-based; either may be zero if the error is not
+	// associated with a position in the source.
+	Line, Column int
+	// LineContents holds the source line containing the error.
+	LineContents string
+	Message      string
+}
+
+func (e *IRParseError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Name, e.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.Name, e.Line, e.Column, e.Message)
+}
+
+// ParseIR parses LLVM IR, in either textual (.ll) or bitcode form, and
+// returns a new module in the context. If parsing fails, the error is an
+// *IRParseError.
+func ParseIR(ctx Context, src []byte) (Module, error) {
+	return parseIR(ctx, src, "<string>")
+}
+
+// ParseIRFile parses the LLVM IR in the named file; see ParseIR.
+func ParseIRFile(ctx Context, path string) (Module, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Module{}, err
+	}
+	return parseIR(ctx, src, path)
+}
+
+func parseIR(ctx Context, src []byte, name string) (m Module, err error) {
+	var csrc *C.char
+	if len(src) > 0 {
+		csrc = (*C.char)(unsafe.Pointer(&src[0]))
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	var cmsg, cline *C.char
+	var line, column C.int
+	m.C = C.gollvm_parse_ir(ctx.C, csrc, C.size_t(len(src)), cname,
+		&cmsg, &cline, &line, &column)
+	if m.C == nil {
+		perr := &IRParseError{
+			Name:         name,
+			Line:         int(line),
+			LineContents: C.GoString(cline),
+			Message:      C.GoString(cmsg),
+		}
+		// LLVM's column numbers are 0-based, and -1 if unknown.
+		if line > 0 && column >= 0 {
+			perr.Column = int(column) + 1
+		}
+		C.LLVMDisposeMessage(cmsg)
+		C.LLVMDisposeMessage(cline)
+		err = perr
+	}
+	return
+}
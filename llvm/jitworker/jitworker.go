@@ -0,0 +1,221 @@
+// Package jitworker runs JIT-compiled functions in a separate worker
+// process, so that crashes in the compiled code do not take down the
+// calling program.
+//
+// The worker is the calling program itself, re-executed with an
+// environment variable set. Programs using this package must therefore
+// call Main at the start of their main function:
+//
+//	func main() {
+//		jitworker.Main()
+//		...
+//	}
+package jitworker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/axw/gollvm/llvm"
+)
+
+// workerEnv is set in the environment of worker processes.
+const workerEnv = "GOLLVM_JITWORKER"
+
+// The worker reads its request from requestFD and writes its response to
+// responseFD, leaving its standard output and error to the compiled code.
+const (
+	requestFD  = 3
+	responseFD = 4
+)
+
+type (
+	// Options configures a call to Run.
+	Options struct {
+		// Timeout is the time after which the worker is killed. Zero
+		// means no timeout.
+		Timeout time.Duration
+		// Stdout receives the worker's standard output. If nil, it is
+		// discarded.
+		Stdout io.Writer
+	}
+
+	// CrashError is returned by Run if the worker process terminated
+	// without returning a result.
+	CrashError struct {
+		// Signal is the signal that terminated the worker, or 0 if it
+		// exited. The worker runs with GOTRACEBACK=crash, so that a fault
+		// in the compiled code, which the Go runtime intercepts, kills it
+		// with SIGABRT rather than exiting; Signal is then the original
+		// signal, as reported by the runtime on standard error.
+		Signal syscall.Signal
+		// ExitStatus is the worker's exit status, or -1 if it was
+		// terminated by a signal.
+		ExitStatus int
+		// TimedOut reports whether the worker was killed because it
+		// exceeded Options.Timeout.
+		TimedOut bool
+		// Stderr is the worker's standard error output.
+		Stderr string
+	}
+
+	request struct {
+		Bitcode  []byte
+		Function string
+		Args     []interface{}
+	}
+
+	response struct {
+		Result interface{}
+		Error  string
+	}
+)
+
+func init() {
+	gob.Register(new(big.Int))
+}
+
+func (e *CrashError) Error() string {
+	switch {
+	case e.TimedOut:
+		return "jitworker: worker timed out"
+	case e.Signal != 0:
+		return fmt.Sprintf("jitworker: worker terminated by signal: %v", e.Signal)
+	}
+	return fmt.Sprintf("jitworker: worker exited with status %d", e.ExitStatus)
+}
+
+// executable returns the path of the running program, which is run again
+// as the worker.
+func executable() (string, error) {
+	if _, err := os.Stat("/proc/self/exe"); err == nil {
+		return "/proc/self/exe", nil
+	}
+	return exec.LookPath(os.Args[0])
+}
+
+// Run JIT-compiles the module in a worker process, calls the named function
+// with args, and returns its result.
+//
+// Arguments are converted to the function's parameter types as by
+// llvm.GenericValueOf, and so may be Go integers, bools, *big.Int values
+// and floating point numbers; pointers cannot be passed between processes.
+// Integer results of up to 64 bits are returned as int64, wider ones as
+// *big.Int, floating point results as float64 and pointer results as
+// uintptr. The result of a void function is nil.
+//
+// If the worker crashes or times out, a *CrashError is returned. The
+// module is not modified.
+func Run(m llvm.Module, function string, args []interface{}, options Options) (interface{}, error) {
+	exe, err := executable()
+	if err != nil {
+		return nil, fmt.Errorf("jitworker: %v", err)
+	}
+	reqr, reqw, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("jitworker: %v", err)
+	}
+	defer reqw.Close()
+	respr, respw, err := os.Pipe()
+	if err != nil {
+		reqr.Close()
+		return nil, fmt.Errorf("jitworker: %v", err)
+	}
+	defer respr.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), workerEnv+"=1", "GOTRACEBACK=crash")
+	cmd.Stdout = options.Stdout
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{reqr, respw}
+	err = cmd.Start()
+	reqr.Close()
+	respw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("jitworker: %v", err)
+	}
+
+	var timedOut int32
+	if options.Timeout > 0 {
+		timer := time.AfterFunc(options.Timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+	}
+
+	// A failure to send the request means the worker has died, which is
+	// reported below.
+	req := request{Bitcode: m.Bitcode(), Function: function, Args: args}
+	gob.NewEncoder(reqw).Encode(&req)
+	reqw.Close()
+
+	var resp response
+	decodeErr := gob.NewDecoder(respr).Decode(&resp)
+	waitErr := cmd.Wait()
+	if decodeErr == nil && waitErr == nil {
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+		return resp.Result, nil
+	}
+
+	if cmd.ProcessState == nil {
+		return nil, fmt.Errorf("jitworker: %v", waitErr)
+	}
+	crash := &CrashError{
+		ExitStatus: -1,
+		TimedOut:   atomic.LoadInt32(&timedOut) != 0,
+		Stderr:     stderr.String(),
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			crash.Signal = status.Signal()
+			if crash.Signal == syscall.SIGABRT && !crash.TimedOut {
+				if sig, ok := runtimeSignal(crash.Stderr); ok {
+					crash.Signal = sig
+				}
+			}
+		} else {
+			crash.ExitStatus = status.ExitStatus()
+		}
+	}
+	return nil, crash
+}
+
+// runtimeSignalRE matches the Go runtime's report of the signal causing a
+// crash: "SIGSEGV: segmentation violation" for faults in Go code, and
+// "[signal SIGSEGV: segmentation violation ...]" for faults elsewhere.
+var runtimeSignalRE = regexp.MustCompile(`(?m)(?:^|\[signal )(SIG[A-Z]+):`)
+
+var runtimeSignals = map[string]syscall.Signal{
+	"SIGABRT": syscall.SIGABRT,
+	"SIGBUS":  syscall.SIGBUS,
+	"SIGFPE":  syscall.SIGFPE,
+	"SIGILL":  syscall.SIGILL,
+	"SIGSEGV": syscall.SIGSEGV,
+	"SIGSYS":  syscall.SIGSYS,
+	"SIGTRAP": syscall.SIGTRAP,
+}
+
+// runtimeSignal returns the signal reported in the Go runtime's crash
+// output.
+func runtimeSignal(stderr string) (syscall.Signal, bool) {
+	m := runtimeSignalRE.FindStringSubmatch(stderr)
+	if m == nil {
+		return 0, false
+	}
+	sig, ok := runtimeSignals[m[1]]
+	return sig, ok
+}
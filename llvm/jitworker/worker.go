@@ -0,0 +1,114 @@
+package jitworker
+
+/*
+#include <stdio.h>
+*/
+import "C"
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/axw/gollvm/llvm"
+)
+
+// Main runs the worker if the program was started as a worker process by
+// Run, in which case it does not return. Otherwise it returns immediately.
+func Main() {
+	if os.Getenv(workerEnv) == "" {
+		return
+	}
+	var req request
+	var resp response
+	if err := gob.NewDecoder(os.NewFile(requestFD, "request")).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("jitworker: reading request: %v", err)
+	} else if result, err := serve(&req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Result = result
+	}
+	// os.Exit does not flush C stdio buffers, which hold any output the
+	// compiled code wrote with printf and the like.
+	C.fflush(nil)
+	if err := gob.NewEncoder(os.NewFile(responseFD, "response")).Encode(&resp); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// serve compiles the requested module and calls the requested function.
+func serve(req *request) (interface{}, error) {
+	llvm.LinkInJIT()
+	llvm.LinkInInterpreter()
+	if err := llvm.InitializeNativeTarget(); err != nil {
+		return nil, err
+	}
+	m, err := llvm.ParseBitcode(req.Bitcode)
+	if err != nil {
+		return nil, fmt.Errorf("jitworker: parsing bitcode: %v", err)
+	}
+	ee, err := llvm.NewExecutionEngine(m)
+	if err != nil {
+		return nil, fmt.Errorf("jitworker: %v", err)
+	}
+	defer ee.Dispose()
+
+	f, ok := ee.FindFunction(req.Function)
+	if !ok {
+		return nil, fmt.Errorf("jitworker: function %q not found", req.Function)
+	}
+	fnType := f.Type().ElementType()
+	params := fnType.ParamTypes()
+	if len(req.Args) != len(params) {
+		return nil, fmt.Errorf("jitworker: %s has %d parameters, got %d arguments",
+			req.Function, len(params), len(req.Args))
+	}
+	args := make([]llvm.GenericValue, len(params))
+	for i, p := range params {
+		if args[i], err = llvm.GenericValueOf(p, req.Args[i]); err != nil {
+			return nil, fmt.Errorf("jitworker: argument %d: %v", i, err)
+		}
+		defer args[i].Dispose()
+	}
+
+	g := ee.RunFunction(f, args)
+	defer g.Dispose()
+	return resultOf(g, fnType.ReturnType())
+}
+
+// resultOf converts a function result to the Go value returned by Run.
+func resultOf(g llvm.GenericValue, t llvm.Type) (interface{}, error) {
+	var result interface{}
+	switch t.TypeKind() {
+	case llvm.VoidTypeKind:
+		return nil, nil
+	case llvm.IntegerTypeKind:
+		if t.IntTypeWidth() <= 64 {
+			result = new(int64)
+		} else {
+			result = new(*big.Int)
+		}
+	case llvm.FloatTypeKind, llvm.DoubleTypeKind:
+		result = new(float64)
+	case llvm.PointerTypeKind:
+		result = new(uintptr)
+	default:
+		return nil, fmt.Errorf("jitworker: unsupported result type %s", t.IRString())
+	}
+	if err := g.Into(t, result); err != nil {
+		return nil, fmt.Errorf("jitworker: result: %v", err)
+	}
+	switch r := result.(type) {
+	case *int64:
+		return *r, nil
+	case **big.Int:
+		return *r, nil
+	case *float64:
+		return *r, nil
+	case *uintptr:
+		return *r, nil
+	}
+	panic("unreachable")
+}
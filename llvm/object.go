@@ -0,0 +1,250 @@
+package llvm
+
+/*
+#include "backports.h"
+#include <llvm-c/Object.h>
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+import "errors"
+
+type (
+	// Object is a parsed object file. It is not named ObjectFile, as that
+	// name is taken by the CodeGenFileType constant.
+	Object struct {
+		C C.LLVMObjectFileRef
+	}
+	SectionIterator struct {
+		C C.LLVMSectionIteratorRef
+	}
+	SymbolIterator struct {
+		C C.LLVMSymbolIteratorRef
+	}
+	RelocationIterator struct {
+		C C.LLVMRelocationIteratorRef
+	}
+
+	// Section is a snapshot of a section in an object file, taken by
+	// Object.Sections.
+	Section struct {
+		Name     string
+		Address  uint64
+		Size     uint64
+		Contents []byte
+		relocs   []Relocation
+	}
+
+	// Symbol is a snapshot of a symbol in an object file, taken by
+	// Object.Symbols.
+	Symbol struct {
+		Name       string
+		Address    uint64
+		FileOffset uint64
+		Size       uint64
+	}
+
+	// Relocation is a snapshot of a relocation entry in a section, taken
+	// by Object.Sections.
+	Relocation struct {
+		Address     uint64
+		Offset      uint64
+		Type        uint64
+		TypeName    string
+		ValueString string
+		Symbol      string
+	}
+)
+
+func (c Object) IsNil() bool             { return c.C == nil }
+func (c SectionIterator) IsNil() bool    { return c.C == nil }
+func (c SymbolIterator) IsNil() bool     { return c.C == nil }
+func (c RelocationIterator) IsNil() bool { return c.C == nil }
+
+var createObjectFileError = errors.New("Failed to create object file")
+
+//-------------------------------------------------------------------------
+// llvm.Object
+//-------------------------------------------------------------------------
+
+// NewObject creates an object from the contents of a memory
+// buffer. The object takes ownership of the buffer, which must not be
+// disposed of separately.
+func NewObject(buf MemoryBuffer) (of Object, err error) {
+	of.C = C.LLVMCreateObjectFile(buf.C)
+	if of.C == nil {
+		err = createObjectFileError
+	}
+	return
+}
+
+// Dispose releases the object and its underlying memory buffer.
+func (of Object) Dispose() { C.LLVMDisposeObjectFile(of.C) }
+
+// SectionIterator returns an iterator positioned at the first section of
+// the object file. The iterator must be disposed of by the caller.
+func (of Object) SectionIterator() (si SectionIterator) {
+	si.C = C.LLVMGetSections(of.C)
+	return
+}
+
+// SymbolIterator returns an iterator positioned at the first symbol of
+// the object file. The iterator must be disposed of by the caller.
+func (of Object) SymbolIterator() (si SymbolIterator) {
+	si.C = C.LLVMGetSymbols(of.C)
+	return
+}
+
+// Sections returns a snapshot of every section in the object file,
+// including each section's contents and relocations.
+func (of Object) Sections() []Section {
+	var sections []Section
+	si := of.SectionIterator()
+	defer si.Dispose()
+	for ; !si.IsAtEnd(of); si.MoveToNext() {
+		s := Section{
+			Name:     si.Name(),
+			Address:  si.Address(),
+			Size:     si.Size(),
+			Contents: si.Contents(),
+		}
+		ri := si.RelocationIterator()
+		for ; !ri.IsAtEnd(si); ri.MoveToNext() {
+			r := Relocation{
+				Address:     ri.Address(),
+				Offset:      ri.Offset(),
+				Type:        ri.Type(),
+				TypeName:    ri.TypeName(),
+				ValueString: ri.ValueString(),
+			}
+			sym := ri.Symbol()
+			if !sym.IsNil() {
+				r.Symbol = sym.Name()
+				sym.Dispose()
+			}
+			s.relocs = append(s.relocs, r)
+		}
+		ri.Dispose()
+		sections = append(sections, s)
+	}
+	return sections
+}
+
+// Symbols returns a snapshot of every symbol in the object file.
+func (of Object) Symbols() []Symbol {
+	var symbols []Symbol
+	si := of.SymbolIterator()
+	defer si.Dispose()
+	for ; !si.IsAtEnd(of); si.MoveToNext() {
+		symbols = append(symbols, Symbol{
+			Name:       si.Name(),
+			Address:    si.Address(),
+			FileOffset: si.FileOffset(),
+			Size:       si.Size(),
+		})
+	}
+	return symbols
+}
+
+// Relocations returns the relocations that apply to the section.
+func (s *Section) Relocations() []Relocation { return s.relocs }
+
+//-------------------------------------------------------------------------
+// llvm.SectionIterator
+//-------------------------------------------------------------------------
+
+func (si SectionIterator) Dispose() { C.LLVMDisposeSectionIterator(si.C) }
+func (si SectionIterator) IsAtEnd(of Object) bool {
+	return C.LLVMIsSectionIteratorAtEnd(of.C, si.C) != 0
+}
+func (si SectionIterator) MoveToNext() { C.LLVMMoveToNextSection(si.C) }
+
+// MoveToContainingSection moves the iterator to the section containing
+// the symbol.
+func (si SectionIterator) MoveToContainingSection(sym SymbolIterator) {
+	C.LLVMMoveToContainingSection(si.C, sym.C)
+}
+
+func (si SectionIterator) Name() string { return C.GoString(C.LLVMGetSectionName(si.C)) }
+func (si SectionIterator) Size() uint64 { return uint64(C.LLVMGetSectionSize(si.C)) }
+func (si SectionIterator) Address() uint64 {
+	return uint64(C.LLVMGetSectionAddress(si.C))
+}
+func (si SectionIterator) Contents() []byte {
+	size := C.LLVMGetSectionSize(si.C)
+	if size == 0 {
+		return nil
+	}
+	cdata := C.LLVMGetSectionContents(si.C)
+	return C.GoBytes(unsafe.Pointer(cdata), C.int(size))
+}
+func (si SectionIterator) ContainsSymbol(sym SymbolIterator) bool {
+	return C.LLVMGetSectionContainsSymbol(si.C, sym.C) != 0
+}
+
+// RelocationIterator returns an iterator positioned at the first
+// relocation of the section. The iterator must be disposed of by the
+// caller.
+func (si SectionIterator) RelocationIterator() (ri RelocationIterator) {
+	ri.C = C.LLVMGetRelocations(si.C)
+	return
+}
+
+//-------------------------------------------------------------------------
+// llvm.SymbolIterator
+//-------------------------------------------------------------------------
+
+func (si SymbolIterator) Dispose() { C.LLVMDisposeSymbolIterator(si.C) }
+func (si SymbolIterator) IsAtEnd(of Object) bool {
+	return C.LLVMIsSymbolIteratorAtEnd(of.C, si.C) != 0
+}
+func (si SymbolIterator) MoveToNext() { C.LLVMMoveToNextSymbol(si.C) }
+
+func (si SymbolIterator) Name() string { return C.GoString(C.LLVMGetSymbolName(si.C)) }
+func (si SymbolIterator) Address() uint64 {
+	return uint64(C.LLVMGetSymbolAddress(si.C))
+}
+func (si SymbolIterator) FileOffset() uint64 {
+	return uint64(C.LLVMGetSymbolFileOffset(si.C))
+}
+func (si SymbolIterator) Size() uint64 { return uint64(C.LLVMGetSymbolSize(si.C)) }
+
+//-------------------------------------------------------------------------
+// llvm.RelocationIterator
+//-------------------------------------------------------------------------
+
+func (ri RelocationIterator) Dispose() { C.LLVMDisposeRelocationIterator(ri.C) }
+func (ri RelocationIterator) IsAtEnd(si SectionIterator) bool {
+	return C.LLVMIsRelocationIteratorAtEnd(si.C, ri.C) != 0
+}
+func (ri RelocationIterator) MoveToNext() { C.LLVMMoveToNextRelocation(ri.C) }
+
+func (ri RelocationIterator) Address() uint64 {
+	return uint64(C.LLVMGetRelocationAddress(ri.C))
+}
+func (ri RelocationIterator) Offset() uint64 {
+	return uint64(C.LLVMGetRelocationOffset(ri.C))
+}
+func (ri RelocationIterator) Type() uint64 {
+	return uint64(C.LLVMGetRelocationType(ri.C))
+}
+
+// Symbol returns an iterator positioned at the symbol the relocation
+// refers to. The iterator must be disposed of by the caller.
+func (ri RelocationIterator) Symbol() (si SymbolIterator) {
+	si.C = C.LLVMGetRelocationSymbol(ri.C)
+	return
+}
+
+func (ri RelocationIterator) TypeName() string {
+	cname := C.gollvm_get_relocation_type_name(ri.C)
+	defer C.free(unsafe.Pointer(cname))
+	return C.GoString(cname)
+}
+func (ri RelocationIterator) ValueString() string {
+	cstr := C.gollvm_get_relocation_value_string(ri.C)
+	defer C.free(unsafe.Pointer(cstr))
+	return C.GoString(cstr)
+}
+
+// vim: set ft=go:
@@ -0,0 +1,154 @@
+package llvm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ObjectCache is an on-disk cache of object files generated for modules,
+// so that identical modules need not be recompiled. Entries are keyed by a
+// hash of the module's bitcode and the configuration of the TargetMachine
+// generating the code.
+type ObjectCache struct {
+	// Dir is the directory holding the cached object files.
+	Dir string
+	// MaxSize is the total size in bytes of the object files beyond which
+	// the least recently used are evicted. Zero means no limit.
+	MaxSize int64
+}
+
+const objectCacheSuffix = ".o"
+
+// NewObjectCache returns a cache storing object files in dir, which is
+// created if necessary, limited to maxSize bytes.
+func NewObjectCache(dir string, maxSize int64) (*ObjectCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ObjectCache{Dir: dir, MaxSize: maxSize}, nil
+}
+
+// Key returns the key identifying the object file generated for the module
+// by the target machine.
+func (c *ObjectCache) Key(tm TargetMachine, m Module) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\x00%d\x00%d\x00",
+		tm.Triple(), tm.CPU(), tm.FeatureString(),
+		tm.OptLevel(), tm.RelocMode(), tm.CodeModel())
+	if err := WriteBitcode(m, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Object returns the object file generated for the module by the target
+// machine, from the cache if present. Otherwise the object file is
+// generated and added to the cache, evicting the least recently used
+// entries if the cache would exceed its maximum size.
+func (c *ObjectCache) Object(tm TargetMachine, m Module) ([]byte, error) {
+	key, err := c.Key(tm, m)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(c.Dir, key+objectCacheSuffix)
+	if data, err := ioutil.ReadFile(path); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return data, nil
+	}
+
+	// Emit to a temporary file that is renamed into place, so that
+	// concurrent users of the cache never see a partial object file.
+	f, err := ioutil.TempFile(c.Dir, "tmp-")
+	if err != nil {
+		return nil, err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+	if err := tm.EmitToFile(m, tmp, ObjectFile); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if err := c.evict(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Clear removes all entries from the cache.
+func (c *ObjectCache) Clear() error {
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if err := os.Remove(filepath.Join(c.Dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries returns the cached object files.
+func (c *ObjectCache) entries() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []os.FileInfo
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), objectCacheSuffix) {
+			entries = append(entries, fi)
+		}
+	}
+	return entries, nil
+}
+
+// evict removes the least recently used entries until the cache is no
+// larger than its maximum size.
+func (c *ObjectCache) evict() error {
+	if c.MaxSize <= 0 {
+		return nil
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, fi := range entries {
+		size += fi.Size()
+	}
+	sort.Sort(byModTime(entries))
+	for _, fi := range entries {
+		if size <= c.MaxSize {
+			break
+		}
+		err := os.Remove(filepath.Join(c.Dir, fi.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= fi.Size()
+	}
+	return nil
+}
+
+// byModTime sorts files from least to most recently modified.
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -4,6 +4,7 @@ package llvm
 #include <llvm-c/Target.h>
 #include <llvm-c/TargetMachine.h>
 #include <stdlib.h>
+#include "backports.h"
 */
 import "C"
 import "unsafe"
@@ -76,6 +77,16 @@ func InitializeAllTargets() { C.LLVMInitializeAllTargets() }
 
 func InitializeAllTargetMCs() { C.LLVMInitializeAllTargetMCs() }
 
+// InitializeAllAsmPrinters - The main program should call this function if
+// it wants all asm printers that LLVM is configured to support, to make them
+// available via TargetMachine.EmitToFile.
+func InitializeAllAsmPrinters() { C.LLVMInitializeAllAsmPrinters() }
+
+// InitializeAllDisassemblers - The main program should call this function if
+// it wants all disassemblers that LLVM is configured to support, to make them
+// available via NewDisassembler.
+func InitializeAllDisassemblers() { C.LLVMInitializeAllDisassemblers() }
+
 var initializeNativeTargetError = errors.New("Failed to initialize native target")
 
 // InitializeNativeTarget - The main program should call this function to
@@ -234,11 +245,71 @@ func (tm TargetMachine) Triple() string {
 	return C.GoString(cstr)
 }
 
+// CPU returns the name of the CPU the machine generates code for.
+func (tm TargetMachine) CPU() string {
+	cstr := C.LLVMGetTargetMachineCPU(tm.C)
+	defer C.LLVMDisposeMessage(cstr)
+	return C.GoString(cstr)
+}
+
+// FeatureString returns the target features the machine was created with.
+func (tm TargetMachine) FeatureString() string {
+	cstr := C.LLVMGetTargetMachineFeatureString(tm.C)
+	defer C.LLVMDisposeMessage(cstr)
+	return C.GoString(cstr)
+}
+
+// OptLevel returns the code generation optimization level of the machine.
+func (tm TargetMachine) OptLevel() CodeGenOptLevel {
+	return CodeGenOptLevel(C.gollvm_get_target_machine_opt_level(tm.C))
+}
+
+// RelocMode returns the relocation model of the machine.
+func (tm TargetMachine) RelocMode() RelocMode {
+	return RelocMode(C.gollvm_get_target_machine_reloc_mode(tm.C))
+}
+
+// CodeModel returns the code model of the machine.
+func (tm TargetMachine) CodeModel() CodeModel {
+	return CodeModel(C.gollvm_get_target_machine_code_model(tm.C))
+}
+
 // TargetData returns the TargetData for the machine.
 func (tm TargetMachine) TargetData() TargetData {
 	return TargetData{C.LLVMGetTargetMachineData(tm.C)}
 }
 
+// EmitToFile generates code for the module, writing it to the named file as
+// either assembly or an object file. The target's asm printer must have
+// been initialized; see InitializeAllAsmPrinters.
+func (tm TargetMachine) EmitToFile(m Module, path string, ft CodeGenFileType) error {
+	var cmsg *C.char
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	fail := C.LLVMTargetMachineEmitToFile(tm.C, m.C, cpath, C.LLVMCodeGenFileType(ft), &cmsg)
+	if fail != 0 {
+		err := errors.New(C.GoString(cmsg))
+		C.LLVMDisposeMessage(cmsg)
+		return err
+	}
+	return nil
+}
+
+// EmitToMemory generates code for the module, returning the assembly or
+// object file contents.
+func (tm TargetMachine) EmitToMemory(m Module, ft CodeGenFileType) ([]byte, error) {
+	var cmsg *C.char
+	var buf MemoryBuffer
+	fail := C.gollvm_target_machine_emit_to_memory_buffer(tm.C, m.C, C.LLVMCodeGenFileType(ft), &cmsg, &buf.C)
+	if fail != 0 {
+		err := errors.New(C.GoString(cmsg))
+		C.LLVMDisposeMessage(cmsg)
+		return nil, err
+	}
+	defer buf.Dispose()
+	return buf.Bytes(), nil
+}
+
 // Dispose releases resources related to the TargetMachine.
 func (tm TargetMachine) Dispose() {
 	C.LLVMDisposeTargetMachine(tm.C)
@@ -13,6 +13,7 @@ func boolToUnsigned(b bool) C.unsigned {
 	return 0
 }
 
+func (pm PassManager) AddAlwaysInlinerPass()         { C.LLVMAddAlwaysInlinerPass(pm.C) }
 func (pm PassManager) AddArgumentPromotionPass()     { C.LLVMAddArgumentPromotionPass(pm.C) }
 func (pm PassManager) AddConstantMergePass()         { C.LLVMAddConstantMergePass(pm.C) }
 func (pm PassManager) AddDeadArgEliminationPass()    { C.LLVMAddDeadArgEliminationPass(pm.C) }
@@ -0,0 +1,133 @@
+package llvm
+
+/*
+#include <stdbool.h>
+#include <llvm-c/Transforms/PassManagerBuilder.h>
+#include "backports.h"
+*/
+import "C"
+
+type (
+	PassManagerBuilder struct {
+		C C.LLVMPassManagerBuilderRef
+	}
+
+	// OptLevel identifies one of the standard optimization pipelines, as
+	// selected by the -O flags of clang and opt.
+	OptLevel int
+)
+
+func (c PassManagerBuilder) IsNil() bool { return c.C == nil }
+
+const (
+	OptLevel0       OptLevel = iota // -O0
+	OptLevel1                       // -O1
+	OptLevel2                       // -O2
+	OptLevel3                       // -O3
+	OptLevelSize                    // -Os
+	OptLevelMinSize                 // -Oz
+)
+
+//-------------------------------------------------------------------------
+// llvm.PassManagerBuilder
+//-------------------------------------------------------------------------
+
+// See llvm::PassManagerBuilder.
+func NewPassManagerBuilder() (pmb PassManagerBuilder) {
+	pmb.C = C.LLVMPassManagerBuilderCreate()
+	return
+}
+
+// NewPassManagerBuilderForLevel returns a builder configured the same way
+// clang configures it for the specified optimization level.
+func NewPassManagerBuilderForLevel(level OptLevel) (pmb PassManagerBuilder) {
+	pmb = NewPassManagerBuilder()
+	switch level {
+	case OptLevel0:
+		pmb.SetOptLevel(0)
+		pmb.UseAlwaysInliner(false)
+	case OptLevel1:
+		pmb.SetOptLevel(1)
+		pmb.UseAlwaysInliner(true)
+	case OptLevel2:
+		pmb.SetOptLevel(2)
+		pmb.UseInlinerWithThreshold(225)
+	case OptLevel3:
+		pmb.SetOptLevel(3)
+		pmb.UseInlinerWithThreshold(275)
+	case OptLevelSize:
+		pmb.SetOptLevel(2)
+		pmb.SetSizeLevel(1)
+		pmb.UseInlinerWithThreshold(75)
+	case OptLevelMinSize:
+		pmb.SetOptLevel(2)
+		pmb.SetSizeLevel(2)
+		pmb.UseInlinerWithThreshold(25)
+	}
+	// Loops are only unrolled at -O2 and -O3.
+	pmb.SetDisableUnrollLoops(level != OptLevel2 && level != OptLevel3)
+	return
+}
+
+// NewStandardPassManagers returns a function pass manager for the module
+// and a module pass manager, both populated with the standard pipeline for
+// the specified optimization level. The function pass manager should be
+// run over each function before the module pass manager is run over the
+// module. Both pass managers must be disposed of by the caller.
+func NewStandardPassManagers(m Module, level OptLevel) (fpm, mpm PassManager) {
+	pmb := NewPassManagerBuilderForLevel(level)
+	defer pmb.Dispose()
+
+	fpm = NewFunctionPassManagerForModule(m)
+	mpm = NewPassManager()
+	pmb.PopulateFunctionPassManager(fpm)
+	pmb.PopulateModulePassManager(mpm)
+	return
+}
+
+func (pmb PassManagerBuilder) SetOptLevel(level int) {
+	C.LLVMPassManagerBuilderSetOptLevel(pmb.C, C.unsigned(level))
+}
+
+func (pmb PassManagerBuilder) SetSizeLevel(level int) {
+	C.LLVMPassManagerBuilderSetSizeLevel(pmb.C, C.unsigned(level))
+}
+
+func (pmb PassManagerBuilder) SetDisableUnitAtATime(val bool) {
+	C.LLVMPassManagerBuilderSetDisableUnitAtATime(pmb.C, boolToLLVMBool(val))
+}
+
+func (pmb PassManagerBuilder) SetDisableUnrollLoops(val bool) {
+	C.LLVMPassManagerBuilderSetDisableUnrollLoops(pmb.C, boolToLLVMBool(val))
+}
+
+func (pmb PassManagerBuilder) SetDisableSimplifyLibCalls(val bool) {
+	C.LLVMPassManagerBuilderSetDisableSimplifyLibCalls(pmb.C, boolToLLVMBool(val))
+}
+
+func (pmb PassManagerBuilder) UseInlinerWithThreshold(threshold int) {
+	C.LLVMPassManagerBuilderUseInlinerWithThreshold(pmb.C, C.unsigned(threshold))
+}
+
+// UseAlwaysInliner makes the builder inline only functions marked
+// always_inline, at the start of the module pipeline. insertLifetime
+// specifies whether lifetime intrinsics are added for the allocas of
+// inlined functions, which clang does not do at -O0.
+func (pmb PassManagerBuilder) UseAlwaysInliner(insertLifetime bool) {
+	C.gollvm_pass_manager_builder_use_always_inliner(pmb.C, boolToLLVMBool(insertLifetime))
+}
+
+func (pmb PassManagerBuilder) PopulateFunctionPassManager(pm PassManager) {
+	C.LLVMPassManagerBuilderPopulateFunctionPassManager(pmb.C, pm.C)
+}
+
+func (pmb PassManagerBuilder) PopulateModulePassManager(pm PassManager) {
+	C.LLVMPassManagerBuilderPopulateModulePassManager(pmb.C, pm.C)
+}
+
+func (pmb PassManagerBuilder) PopulateLTOPassManager(pm PassManager, internalize, runInliner bool) {
+	C.LLVMPassManagerBuilderPopulateLTOPassManager(pmb.C, pm.C,
+		C.bool(internalize), C.bool(runInliner))
+}
+
+func (pmb PassManagerBuilder) Dispose() { C.LLVMPassManagerBuilderDispose(pmb.C) }